@@ -1,19 +1,54 @@
 package main
 
 import (
+	"bytes"
+	"compress/gzip"
+	"container/list"
 	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/tls"
 	"database/sql"
+	"encoding"
+	"encoding/binary"
+	"encoding/csv"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
 	"log"
+	"math"
 	"math/rand"
+	"mime"
+	"net"
 	"net/http"
+	"net/url"
+	"os"
+	"os/signal"
+	"reflect"
+	"runtime"
+	"runtime/debug"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
+	"unicode"
+	"unicode/utf8"
 
 	"github.com/labstack/echo/v4"
 	"github.com/labstack/echo/v4/middleware"
-	_ "github.com/mattn/go-sqlite3"
+	"github.com/mattn/go-sqlite3"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
 	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
 	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
 	"go.opentelemetry.io/otel/sdk/resource"
 	sdktrace "go.opentelemetry.io/otel/sdk/trace"
@@ -22,25 +57,393 @@ import (
 )
 
 type TodoItem struct {
-	ID          int    `json:"id"`
-	Title       string `json:"title"`
-	Description string `json:"description,omitempty"`
-	Completed   bool   `json:"completed"`
+	ID          int     `json:"id"`
+	Title       string  `json:"title"`
+	Description *string `json:"description,omitempty"` // nil is stored as NULL
+	Completed   bool    `json:"completed"`
+	Status      string  `json:"status,omitempty"`
+	Pinned      bool    `json:"pinned"`
+}
+
+// CSV has no NULL, so exports write an absent description as empty.
+func (t TodoItem) descriptionOrEmpty() string {
+	if t.Description == nil {
+		return ""
+	}
+	return *t.Description
+}
+
+// dedupeKey identifies identical create requests. An absent description
+// differs from an empty one.
+func (t TodoItem) dedupeKey() string {
+	key := t.Title + "\x00"
+	if t.Description != nil {
+		key += "\x00" + *t.Description
+	}
+	return key
+}
+
+// todoColumns is the column list scanned by scanTodo.
+const todoColumns = "id, title, description, completed, status, pinned"
+
+type rowScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+func scanTodo(row rowScanner) (TodoItem, error) {
+	var todo TodoItem
+	err := row.Scan(&todo.ID, &todo.Title, &todo.Description, &todo.Completed, &todo.Status, &todo.Pinned)
+	return todo, err
+}
+
+const (
+	statusTodo       = "todo"
+	statusInProgress = "in_progress"
+	statusDone       = "done"
+)
+
+// errDescriptionTooLong is raised by the description length trigger.
+const errDescriptionTooLong = "description too long"
+
+// validationError reports a request body that parsed but failed validation.
+// It is rendered as a 422 listing the offending fields.
+type validationError struct {
+	fields map[string]string
+}
+
+func (e *validationError) Error() string {
+	return fmt.Sprintf("validation failed: %v", e.fields)
+}
+
+func normalizeTitle(title string) string {
+	if !normalizeTitles {
+		return title
+	}
+	title = strings.Join(strings.Fields(title), " ")
+	if lowercaseTitles {
+		title = strings.ToLower(title)
+	}
+	return title
+}
+
+func validateTodo(todo TodoItem) error {
+	fields := make(map[string]string)
+	if strings.TrimSpace(todo.Title) == "" {
+		fields["title"] = "is required"
+	}
+	if maxDescriptionLength > 0 && todo.Description != nil && utf8.RuneCountInString(*todo.Description) > maxDescriptionLength {
+		fields["description"] = fmt.Sprintf("must be at most %d characters", maxDescriptionLength)
+	}
+	if _, ok := statusTransitions[todo.Status]; todo.Status != "" && !ok {
+		fields["status"] = fmt.Sprintf("must be one of %s, %s or %s", statusTodo, statusInProgress, statusDone)
+	}
+	if len(fields) > 0 {
+		return &validationError{fields: fields}
+	}
+	return nil
+}
+
+// statusTransitions lists the statuses each status may move to. Keeping the
+// same status is always allowed.
+var statusTransitions = map[string][]string{
+	statusTodo:       {statusInProgress, statusDone},
+	statusInProgress: {statusTodo, statusDone},
+	statusDone:       {statusTodo},
+}
+
+func canTransition(from, to string) bool {
+	if from == to {
+		return true
+	}
+	for _, next := range statusTransitions[from] {
+		if next == to {
+			return true
+		}
+	}
+	return false
+}
+
+// resolveStatus makes Status and Completed agree. An explicit, validated
+// status wins; otherwise the boolean decides, keeping an in-progress current
+// status when the todo is still not completed.
+func resolveStatus(todo *TodoItem, current string) {
+	switch {
+	case todo.Status != "":
+	case todo.Completed:
+		todo.Status = statusDone
+	case current == statusInProgress:
+		todo.Status = statusInProgress
+	default:
+		todo.Status = statusTodo
+	}
+	todo.Completed = todo.Status == statusDone
+}
+
+// maxPageSize bounds limit parameters so absurd values are rejected before
+// they reach the database.
+const maxPageSize = 1000
+
+// maxLongPollWait caps how long GET /todos?wait= may block.
+const maxLongPollWait = time.Minute
+
+// changeNotifier versions the todo list and wakes waiters whenever it
+// changes.
+type changeNotifier struct {
+	mu      sync.Mutex
+	version uint64
+	changed chan struct{}
+}
+
+func newChangeNotifier() *changeNotifier {
+	return &changeNotifier{changed: make(chan struct{})}
+}
+
+// current returns the current version and a channel that is closed on the
+// next change.
+func (n *changeNotifier) current() (uint64, <-chan struct{}) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.version, n.changed
+}
+
+func (n *changeNotifier) notify() {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.version++
+	close(n.changed)
+	n.changed = make(chan struct{})
+}
+
+// pollRelease hands long polls a channel that stays closed for as long as
+// something waits for them to finish, so a poll that starts in the meantime
+// does not park at all.
+type pollRelease struct {
+	mu sync.Mutex
+	ch chan struct{}
+}
+
+func newPollRelease() *pollRelease {
+	return &pollRelease{ch: make(chan struct{})}
+}
+
+func (r *pollRelease) done() <-chan struct{} {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.ch
+}
+
+// release ends all current and future waits until reset is called.
+func (r *pollRelease) release() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	select {
+	case <-r.ch:
+	default:
+		close(r.ch)
+	}
+}
+
+func (r *pollRelease) reset() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.ch = make(chan struct{})
 }
 
 var (
+	// appRegistry holds the business metrics served on /metrics/app. Go
+	// runtime and process metrics stay on the default registry at /metrics.
+	appRegistry = prometheus.NewRegistry()
+
 	db              *sql.DB
 	tracer          trace.Tracer
-	userStatus      *prometheus.CounterVec
 	requestCount    *prometheus.CounterVec
 	todoActionCount *prometheus.CounterVec
+	inFlight        prometheus.Gauge
+	routeInFlight   *prometheus.GaugeVec
+	todoItems       *prometheus.GaugeVec
+	oldestPending   prometheus.Gauge
+	dbQueryDuration *prometheus.HistogramVec
+	dbActiveTx      prometheus.Gauge
+	dbFileSize      prometheus.Gauge
+	encodeErrors    prometheus.Counter
+	dbPoolExhausted prometheus.Counter
+
+	listCacheEntries prometheus.Gauge
+	traceLastExport  prometheus.Gauge
+	dbSlowQueries    *prometheus.CounterVec
+	requestDuration  *prometheus.HistogramVec
+
+	// dbAttributes describe the database backend on every DB span. They are
+	// resolved once in initDB.
+	dbAttributes []attribute.KeyValue
+
+	todoChanges = newChangeNotifier()
+	// longPolls releases parked long polls for a rotate or a shutdown.
+	longPolls = newPollRelease()
+
+	// stmts is nil unless DB_STMT_CACHE is enabled.
+	stmts *stmtCache
+
+	// listCache is nil unless LIST_CACHE_SIZE is set.
+	listCache *responseCache
+
+	// createDedupe is nil unless CREATE_DEDUPE_WINDOW is set.
+	createDedupe *createDeduper
+
+	// dbPath is the SQLite database opened by initDB.
+	dbPath = "./test.db"
+
+	// location is the timezone configured with TIMEZONE.
+	location = time.Local
+
+	// maxDescriptionLength limits descriptions, in characters, in both the
+	// API and the database. Zero disables the limit.
+	maxDescriptionLength = 1000
+
+	// dbSpanSampleRatio is the share of DB operations that get a child span.
+	dbSpanSampleRatio = 1.0
+
+	// slowQueryThreshold logs and counts DB operations at least this slow.
+	// Zero disables it.
+	slowQueryThreshold time.Duration
+
+	// recentTraces feeds /debug/recent-traces.
+	recentTraces = newTraceRing(0)
+
+	// traceMemStats adds heap allocation attributes to heavy endpoint spans.
+	// ReadMemStats stops the world, so it is off unless TRACE_MEM_STATS is set.
+	traceMemStats = false
+
+	// normalizeTitles trims titles and collapses inner whitespace before they
+	// are stored, and lowercaseTitles also lowercases them, so the unique
+	// title index catches near-duplicates.
+	normalizeTitles = false
+	lowercaseTitles = false
+
+	// uniqueTitles enforces one todo per title with a unique index. It is
+	// configured with UNIQUE_TITLES.
+	uniqueTitles = false
+)
+
+// version and commit are set at build time with
+// -ldflags "-X main.version=... -X main.commit=...".
+var (
+	version = "dev"
+	commit  = ""
+)
+
+// buildCommit falls back to the VCS revision embedded by go build.
+func buildCommit() string {
+	if commit != "" {
+		return commit
+	}
+	if info, ok := debug.ReadBuildInfo(); ok {
+		for _, setting := range info.Settings {
+			if setting.Key == "vcs.revision" {
+				return setting.Value
+			}
+		}
+	}
+	return "unknown"
+}
+
+// statsMetrics lists the metric families exposed as JSON on /stats.
+var statsMetrics = []string{"http_request_count", "http_todo_count", "http_in_flight_requests"}
+
+func envString(key, fallback string) string {
+	if v := os.Getenv(key); v != "" {
+		return v
+	}
+	return fallback
+}
+
+func envBool(key string, fallback bool) (bool, error) {
+	v := os.Getenv(key)
+	if v == "" {
+		return fallback, nil
+	}
+	b, err := strconv.ParseBool(v)
+	if err != nil {
+		return fallback, fmt.Errorf("invalid %s: %w", key, err)
+	}
+	return b, nil
+}
+
+func envDuration(key string, fallback time.Duration) (time.Duration, error) {
+	v := os.Getenv(key)
+	if v == "" {
+		return fallback, nil
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil {
+		return fallback, fmt.Errorf("invalid %s: %w", key, err)
+	}
+	return d, nil
+}
+
+func envFloat(key string, fallback float64) (float64, error) {
+	v := os.Getenv(key)
+	if v == "" {
+		return fallback, nil
+	}
+	f, err := strconv.ParseFloat(v, 64)
+	if err != nil {
+		return fallback, fmt.Errorf("invalid %s: %w", key, err)
+	}
+	return f, nil
+}
+
+func envInt(key string, fallback int) (int, error) {
+	v := os.Getenv(key)
+	if v == "" {
+		return fallback, nil
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil {
+		return fallback, fmt.Errorf("invalid %s: %w", key, err)
+	}
+	return n, nil
+}
+
+// todoAction is a value of the todoActionCount "action" label. It is a struct
+// rather than a string so an untyped constant cannot convert to it: only the
+// values below exist and recordTodoAction("craeted") does not compile, which
+// keeps typos from creating new series.
+type todoAction struct {
+	label string
+}
+
+var (
+	actionCreated  = todoAction{"created"}
+	actionUpdated  = todoAction{"updated"}
+	actionDeleted  = todoAction{"deleted"}
+	actionPinned   = todoAction{"pinned"}
+	actionUnpinned = todoAction{"unpinned"}
 )
 
-func initMetrics() {
-	userStatus = prometheus.NewCounterVec(prometheus.CounterOpts{
-		Name: "http_request_get_user_status_count",
-		Help: "Count of status returned by user",
-	}, []string{"user", "status"})
+func recordTodoAction(action todoAction) {
+	todoActionCount.WithLabelValues(action.label).Inc()
+}
+
+func initMetrics(demo bool) error {
+	// The synthetic user status series only exist in demo mode, where the
+	// producer feeds them.
+	if demo {
+		if err := initDemoMetrics(); err != nil {
+			return err
+		}
+	}
+
+	// The info series describes the process, so it sits with the runtime
+	// metrics. Registering it on appRegistry too would duplicate it wherever
+	// both registries are gathered together.
+	serviceInfo := prometheus.NewGauge(prometheus.GaugeOpts{
+		Name:        "todo_service_info",
+		Help:        "Build information about the running todo service",
+		ConstLabels: prometheus.Labels{"version": version, "commit": buildCommit()},
+	})
+	serviceInfo.Set(1)
+	prometheus.MustRegister(serviceInfo)
 
 	requestCount = prometheus.NewCounterVec(prometheus.CounterOpts{
 		Name: "http_request_count",
@@ -52,43 +455,270 @@ func initMetrics() {
 		Help: "Count of todos",
 	}, []string{"action"})
 
-	prometheus.MustRegister(userStatus, requestCount, todoActionCount)
+	inFlight = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "http_in_flight_requests",
+		Help: "Number of requests currently being served",
+	})
+
+	routeInFlight = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "http_requests_in_flight",
+		Help: "Number of requests currently being served by route",
+	}, []string{"endpoint"})
+
+	todoItems = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "todo_items",
+		Help: "Number of stored todos by state",
+	}, []string{"state"})
+
+	oldestPending = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "oldest_pending_todo_age_seconds",
+		Help: "Age of the oldest todo that is not completed",
+	})
+
+	dbQueryDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "db_query_duration_seconds",
+		Help:    "Duration of database operations",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"operation"})
+
+	dbActiveTx = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "db_active_transactions",
+		Help: "Number of database transactions that are open",
+	})
+
+	dbFileSize = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "db_file_size_bytes",
+		Help: "Size of the SQLite database file",
+	})
+
+	encodeErrors = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "http_response_encode_errors_total",
+		Help: "Number of responses whose body failed to encode",
+	})
+
+	dbPoolExhausted = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "db_pool_exhausted_total",
+		Help: "Number of database operations that timed out waiting for a free connection",
+	})
+
+	listCacheEntries = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "list_cache_entries",
+		Help: "Number of list responses held in the response cache",
+	})
+
+	traceLastExport = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "trace_last_export_success_timestamp_seconds",
+		Help: "Unix time of the last successful trace export",
+	})
+
+	dbSlowQueries = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "db_slow_queries_total",
+		Help: "Number of database operations slower than SLOW_QUERY_THRESHOLD",
+	}, []string{"operation"})
+
+	requestDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "http_request_duration_seconds",
+		Help:    "Duration of HTTP requests by route",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"method", "endpoint"})
+
+	registerApp(requestCount, todoActionCount, inFlight, routeInFlight, todoItems, oldestPending,
+		dbQueryDuration, dbActiveTx, dbFileSize, encodeErrors, dbPoolExhausted, listCacheEntries, traceLastExport,
+		dbSlowQueries, requestDuration)
+	return nil
 }
 
-func initTracer() trace.Tracer {
-	exporter, err := otlptracehttp.New(
-		context.Background(),
-		otlptracehttp.WithEndpoint("localhost:4318"), // Default OTLP HTTP port
-		otlptracehttp.WithInsecure(),                 // Skip TLS for local development
-	)
+// registerApp registers cs on appRegistry, each behind a recoveringCollector.
+func registerApp(cs ...prometheus.Collector) {
+	for _, c := range cs {
+		appRegistry.MustRegister(recoveringCollector{c})
+	}
+}
+
+var collectorPanicDesc = prometheus.NewDesc("collector_panic", "A metrics collector panicked", nil, nil)
+
+// recoveringCollector reports a panic in Collect as an invalid metric, so
+// Gather returns an error instead of crashing the process. The recover has to
+// live here: Gather calls Collect on its own goroutines.
+type recoveringCollector struct {
+	prometheus.Collector
+}
+
+func (r recoveringCollector) Collect(ch chan<- prometheus.Metric) {
+	defer func() {
+		if p := recover(); p != nil {
+			ch <- prometheus.NewInvalidMetric(collectorPanicDesc, fmt.Errorf("collector panicked: %v", p))
+		}
+	}()
+	r.Collector.Collect(ch)
+}
+
+const urlPathKey = attribute.Key("url.path")
+
+// pathSampler drops spans for low-value paths such as health checks and
+// defers to the wrapped sampler for everything else.
+type pathSampler struct {
+	dropPaths map[string]bool
+	next      sdktrace.Sampler
+}
+
+func (s pathSampler) ShouldSample(p sdktrace.SamplingParameters) sdktrace.SamplingResult {
+	for _, attr := range p.Attributes {
+		if attr.Key == urlPathKey && s.dropPaths[attr.Value.AsString()] {
+			return sdktrace.SamplingResult{
+				Decision:   sdktrace.Drop,
+				Tracestate: trace.SpanContextFromContext(p.ParentContext).TraceState(),
+			}
+		}
+	}
+	return s.next.ShouldSample(p)
+}
+
+func (s pathSampler) Description() string {
+	return "PathSampler{" + s.next.Description() + "}"
+}
+
+// otlpOptions turns an OTLP endpoint into exporter options. WithEndpoint only
+// accepts host:port, so a URL's scheme picks TLS or plain HTTP instead and a
+// bare host:port keeps using plain HTTP for local development.
+func otlpOptions(endpoint string) ([]otlptracehttp.Option, error) {
+	if !strings.Contains(endpoint, "://") {
+		return []otlptracehttp.Option{
+			otlptracehttp.WithEndpoint(endpoint),
+			otlptracehttp.WithInsecure(),
+		}, nil
+	}
+
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return nil, err
+	}
+	if u.Host == "" {
+		return nil, fmt.Errorf("OTLP endpoint %q has no host", endpoint)
+	}
+
+	opts := []otlptracehttp.Option{otlptracehttp.WithEndpoint(u.Host)}
+	switch u.Scheme {
+	case "http":
+		opts = append(opts, otlptracehttp.WithInsecure())
+	case "https":
+	default:
+		return nil, fmt.Errorf("unsupported OTLP endpoint scheme %q", u.Scheme)
+	}
+	// Like the SDK's own handling of the variable, a base path gets the
+	// traces signal path appended.
+	if path := strings.TrimSuffix(u.Path, "/"); path != "" {
+		opts = append(opts, otlptracehttp.WithURLPath(path+"/v1/traces"))
+	}
+	return opts, nil
+}
+
+// exportTimestamper records the time of every successful export so a stale
+// trace_last_export_success_timestamp_seconds reveals a broken pipeline.
+type exportTimestamper struct {
+	sdktrace.SpanExporter
+}
+
+func (e exportTimestamper) ExportSpans(ctx context.Context, spans []sdktrace.ReadOnlySpan) error {
+	if err := e.SpanExporter.ExportSpans(ctx, spans); err != nil {
+		return err
+	}
+	traceLastExport.SetToCurrentTime()
+	return nil
+}
+
+func initTracer() (*sdktrace.TracerProvider, error) {
+	opts, err := otlpOptions(envString("OTEL_EXPORTER_OTLP_ENDPOINT", "localhost:4318")) // Default OTLP HTTP port
+	if err != nil {
+		return nil, fmt.Errorf("invalid OTEL_EXPORTER_OTLP_ENDPOINT: %w", err)
+	}
+
+	exporter, err := otlptracehttp.New(context.Background(), opts...)
 	if err != nil {
-		log.Fatalf("failed to create OTLP exporter: %v", err)
+		return nil, fmt.Errorf("failed to create OTLP exporter: %w", err)
 	}
 
+	serviceName := envString("OTEL_SERVICE_NAME", "todo-service")
 	res, err := resource.New(
 		context.Background(),
 		resource.WithAttributes(
-			semconv.ServiceName("todo-service"),
+			semconv.ServiceName(serviceName),
 		),
 	)
 	if err != nil {
-		log.Fatalf("failed to create resource: %v", err)
+		return nil, fmt.Errorf("failed to create resource: %w", err)
+	}
+
+	ratio, err := envFloat("TRACE_SAMPLE_RATIO", 1.0)
+	if err != nil {
+		return nil, err
+	}
+	sampler := pathSampler{
+		dropPaths: parseSet(envString("TRACE_DROP_PATHS", "/healthz,/readyz,/metrics,/metrics/app")),
+		next:      sdktrace.ParentBased(sdktrace.TraceIDRatioBased(ratio)),
 	}
 
 	tp := sdktrace.NewTracerProvider(
-		sdktrace.WithBatcher(exporter),
+		sdktrace.WithSampler(sampler),
+		sdktrace.WithBatcher(exportTimestamper{exporter}),
 		sdktrace.WithResource(res),
 	)
 	otel.SetTracerProvider(tp)
-
-	return tp.Tracer("todo-service")
+	return tp, nil
 }
 
-func initDB() {
-	var err error
-	db, err = sql.Open("sqlite3", "./test.db")
+func initDB() error {
+	// Settings are parsed up front so a bad value never leaves a half-opened
+	// database behind.
+	maxIdleTime, err := envDuration("DB_CONN_MAX_IDLE_TIME", 0) // 0 keeps idle connections indefinitely
+	if err != nil {
+		return err
+	}
+	maxOpen, err := envInt("DB_MAX_OPEN_CONNS", 0) // 0 means unlimited
+	if err != nil {
+		return err
+	}
+	backup, err := envBool("BACKUP_BEFORE_MIGRATE", false)
+	if err != nil {
+		return err
+	}
+	warmup, err := envInt("DB_WARMUP_CONNS", 0)
+	if err != nil {
+		return err
+	}
+
+	// Only an existing database has anything worth backing up.
+	_, statErr := os.Stat(dbPath)
+	existing := statErr == nil && !isInMemoryDB(dbPath)
+
+	db, err = sql.Open("sqlite3", dbPath)
 	if err != nil {
-		log.Fatalf("failed to open database: %v", err)
+		return fmt.Errorf("failed to open database: %w", err)
+	}
+
+	var version string
+	if err := db.QueryRow("SELECT sqlite_version()").Scan(&version); err != nil {
+		return fmt.Errorf("failed to query database version: %w", err)
+	}
+	dbAttributes = []attribute.KeyValue{
+		semconv.DBSystemSqlite,
+		attribute.String("db.driver", "sqlite3"),
+		attribute.String("db.version", version),
+	}
+	db.SetConnMaxIdleTime(maxIdleTime)
+
+	if isInMemoryDB(dbPath) {
+		maxOpen = 1 // Each connection would otherwise get its own empty database
+	}
+	db.SetMaxOpenConns(maxOpen)
+
+	if existing && backup {
+		backupPath := fmt.Sprintf("%s.%s.bak", dbPath, time.Now().UTC().Format("20060102T150405Z"))
+		// VACUUM INTO writes a consistent copy even while the file is open.
+		if _, err := db.Exec("VACUUM INTO ?", backupPath); err != nil {
+			return fmt.Errorf("failed to back up database before migrating: %w", err)
+		}
+		log.Printf("backed up database to %s", backupPath)
 	}
 
 	_, err = db.Exec(`CREATE TABLE IF NOT EXISTS todos (
@@ -98,109 +728,2739 @@ func initDB() {
 		completed BOOLEAN DEFAULT 0
 	);`)
 	if err != nil {
-		log.Fatalf("failed to create table: %v", err)
+		return fmt.Errorf("failed to create table: %w", err)
 	}
-}
-
-func getTodos(c echo.Context) error {
-	_, span := tracer.Start(c.Request().Context(), "getTodos")
-	defer span.End()
 
-	rows, err := db.Query("SELECT id, title, description, completed FROM todos")
+	added, err := addColumnIfMissing("todos", "status", "TEXT NOT NULL DEFAULT 'todo'")
 	if err != nil {
-		return echo.NewHTTPError(http.StatusInternalServerError, "failed to query todos")
+		return fmt.Errorf("failed to add status column: %w", err)
 	}
-	defer rows.Close()
-
-	var todos []TodoItem
-	for rows.Next() {
-		var todo TodoItem
-		if err := rows.Scan(&todo.ID, &todo.Title, &todo.Description, &todo.Completed); err != nil {
-			return echo.NewHTTPError(http.StatusInternalServerError, "failed to scan row")
+	if added {
+		if _, err := db.Exec(`UPDATE todos SET status = 'done' WHERE completed`); err != nil {
+			return fmt.Errorf("failed to backfill status column: %w", err)
 		}
-		todos = append(todos, todo)
 	}
 
-	requestCount.WithLabelValues(http.MethodGet, "/todos").Inc()
-	return c.JSON(http.StatusOK, todos)
-}
+	if _, err := addColumnIfMissing("todos", "pinned", "BOOLEAN NOT NULL DEFAULT 0"); err != nil {
+		return fmt.Errorf("failed to add pinned column: %w", err)
+	}
+	// revision counts the upsert updates to a row, so a row an upsert returns
+	// with revision 0 was just inserted.
+	if _, err := addColumnIfMissing("todos", "revision", "INTEGER NOT NULL DEFAULT 0"); err != nil {
+		return fmt.Errorf("failed to add revision column: %w", err)
+	}
 
-func createTodo(c echo.Context) error {
-	_, span := tracer.Start(c.Request().Context(), "createTodo")
-	defer span.End()
+	// SQLite cannot add a column with a CURRENT_TIMESTAMP default, so
+	// created_at and updated_at are set by the writes and stay NULL for older
+	// rows.
+	if _, err := addColumnIfMissing("todos", "created_at", "DATETIME"); err != nil {
+		return fmt.Errorf("failed to add created_at column: %w", err)
+	}
+	if _, err := addColumnIfMissing("todos", "updated_at", "DATETIME"); err != nil {
+		return fmt.Errorf("failed to add updated_at column: %w", err)
+	}
 
-	var todo TodoItem
-	if err := c.Bind(&todo); err != nil {
-		return echo.NewHTTPError(http.StatusBadRequest, "invalid request body")
+	// The trigger enforces the description limit for writes that bypass the
+	// API. It is recreated on every start so it follows the configured limit.
+	if _, err := db.Exec(`DROP TRIGGER IF EXISTS todos_description_length_insert`); err != nil {
+		return fmt.Errorf("failed to drop description trigger: %w", err)
+	}
+	if _, err := db.Exec(`DROP TRIGGER IF EXISTS todos_description_length_update`); err != nil {
+		return fmt.Errorf("failed to drop description trigger: %w", err)
+	}
+	if maxDescriptionLength > 0 {
+		for _, event := range []string{"INSERT", "UPDATE"} {
+			_, err := db.Exec(fmt.Sprintf(`CREATE TRIGGER todos_description_length_%s
+				BEFORE %s ON todos
+				WHEN length(NEW.description) > %d
+				BEGIN SELECT RAISE(ABORT, '%s'); END;`,
+				strings.ToLower(event), event, maxDescriptionLength, errDescriptionTooLong))
+			if err != nil {
+				return fmt.Errorf("failed to create description trigger: %w", err)
+			}
+		}
 	}
 
-	result, err := db.Exec("INSERT INTO todos (title, description, completed) VALUES (?, ?, ?)",
-		todo.Title, todo.Description, todo.Completed)
-	if err != nil {
-		return echo.NewHTTPError(http.StatusInternalServerError, "failed to insert todo")
+	// Like the triggers, the title index follows the configuration on every
+	// start.
+	if uniqueTitles {
+		if err := createTitleIndex(); err != nil {
+			return fmt.Errorf("failed to create title index: %w", err)
+		}
+	} else if _, err := db.Exec(`DROP INDEX IF EXISTS idx_todos_title`); err != nil {
+		return fmt.Errorf("failed to drop title index: %w", err)
 	}
 
-	id, _ := result.LastInsertId()
-	todo.ID = int(id)
+	// Tombstones let sync clients learn about deletions after the fact.
+	_, err = db.Exec(`CREATE TABLE IF NOT EXISTS todo_tombstones (
+		seq INTEGER PRIMARY KEY AUTOINCREMENT,
+		todo_id INTEGER NOT NULL,
+		deleted_at DATETIME DEFAULT CURRENT_TIMESTAMP
+	);`)
+	if err != nil {
+		return fmt.Errorf("failed to create tombstone table: %w", err)
+	}
 
-	todoActionCount.WithLabelValues("created").Inc()
-	requestCount.WithLabelValues(http.MethodPost, "/todos").Inc()
-	return c.JSON(http.StatusCreated, todo)
+	if maxOpen > 0 {
+		warmup = min(warmup, maxOpen)
+	}
+	if warmup > 0 {
+		// Keep the warmed connections around once they are released.
+		db.SetMaxIdleConns(max(warmup, 2))
+		if err := warmupDB(context.Background(), warmup); err != nil {
+			log.Printf("failed to warm up database connections: %v", err)
+		}
+	}
+	return nil
 }
 
-func deleteTodo(c echo.Context) error {
-	_, span := tracer.Start(c.Request().Context(), "deleteTodo")
-	defer span.End()
-
-	id := c.Param("id")
-	_, err := db.Exec("DELETE FROM todos WHERE id = ?", id)
+// createTitleIndex adds the unique title index. Existing duplicates keep the
+// oldest todo's title and get their id appended on the others, e.g.
+// "Buy milk (12)", so enabling UNIQUE_TITLES does not fail on old data.
+func createTitleIndex() error {
+	tx, err := db.Begin()
 	if err != nil {
-		return echo.NewHTTPError(http.StatusInternalServerError, "failed to delete todo")
+		return err
 	}
+	defer tx.Rollback()
 
-	todoActionCount.WithLabelValues("deleted").Inc()
-	requestCount.WithLabelValues(http.MethodDelete, "/todos/:id").Inc()
-	return c.NoContent(http.StatusNoContent)
+	result, err := tx.Exec(`UPDATE todos SET title = title || ' (' || id || ')'
+		WHERE id NOT IN (SELECT MIN(id) FROM todos GROUP BY title)`)
+	if err != nil {
+		return fmt.Errorf("failed to rename duplicate titles: %w", err)
+	}
+	if renamed, _ := result.RowsAffected(); renamed > 0 {
+		log.Printf("renamed %d todos with duplicate titles", renamed)
+	}
+	if _, err := tx.Exec(`CREATE UNIQUE INDEX IF NOT EXISTS idx_todos_title ON todos (title)`); err != nil {
+		return err
+	}
+	return tx.Commit()
 }
 
-func metricsHandler(c echo.Context) error {
-	promHandler := promhttp.Handler()
-	promHandler.ServeHTTP(c.Response(), c.Request())
-	return nil
+func isInMemoryDB(path string) bool {
+	return path == ":memory:" || strings.HasPrefix(path, "file::memory:") || strings.Contains(path, "mode=memory")
 }
 
-func producer() {
-	users := []string{"bob", "alice", "jack"}
-	for {
-		user := users[rand.Intn(len(users))]
-		status := "2xx"
-		if rand.Float64() > 0.8 {
-			status = "4xx"
+// warmupDB opens and pings n connections at the same time so they sit idle in
+// the pool before the first burst of requests.
+func warmupDB(ctx context.Context, n int) error {
+	conns := make([]*sql.Conn, 0, n)
+	defer func() {
+		for _, conn := range conns {
+			conn.Close()
+		}
+	}()
+
+	for i := 0; i < n; i++ {
+		conn, err := db.Conn(ctx)
+		if err != nil {
+			return err
+		}
+		conns = append(conns, conn)
+		if err := conn.PingContext(ctx); err != nil {
+			return err
 		}
-		userStatus.WithLabelValues(user, status).Inc()
-		time.Sleep(2 * time.Second)
 	}
+	return nil
 }
 
-func main() {
-	// Initialize components
-	initDB()
-	initMetrics()
-	tracer = initTracer()
-
-	e := echo.New()
-	e.Use(middleware.Logger())
-	e.Use(middleware.Recover())
-
-	// Routes
+func addColumnIfMissing(table, column, definition string) (bool, error) {
+	rows, err := db.Query("SELECT name FROM pragma_table_info(?)", table)
+	if err != nil {
+		return false, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return false, err
+		}
+		if name == column {
+			return false, nil
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return false, err
+	}
+
+	_, err = db.Exec(fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s %s", table, column, definition))
+	return err == nil, err
+}
+
+// observeDB records the metrics for a finished database operation and logs it
+// when it took longer than SLOW_QUERY_THRESHOLD.
+func observeDB(ctx context.Context, operation, statement string, elapsed time.Duration, err error) {
+	dbQueryDuration.WithLabelValues(operation).Observe(elapsed.Seconds())
+	checkPoolExhausted(ctx, err)
+	if slowQueryThreshold > 0 && elapsed >= slowQueryThreshold {
+		dbSlowQueries.WithLabelValues(operation).Inc()
+		log.Printf("WARN slow %s query took %s: %s", operation, elapsed, strings.Join(strings.Fields(statement), " "))
+	}
+}
+
+// traceDB instruments a database operation. The returned function records its
+// duration and, for the DB_SPAN_SAMPLE_RATIO share of calls that get a child
+// span, ends the span with the operation's error, if any.
+func traceDB(ctx context.Context, operation, statement string) (context.Context, func(error)) {
+	start := time.Now()
+	if rand.Float64() >= dbSpanSampleRatio {
+		return ctx, func(err error) {
+			observeDB(ctx, operation, statement, time.Since(start), err)
+		}
+	}
+
+	ctx, span := tracer.Start(ctx, "db "+operation,
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(dbAttributes...),
+		trace.WithAttributes(semconv.DBOperation(operation)),
+	)
+	return ctx, func(err error) {
+		observeDB(ctx, operation, statement, time.Since(start), err)
+		if err != nil {
+			span.RecordError(err)
+			span.SetStatus(codes.Error, err.Error())
+		}
+		span.End()
+	}
+}
+
+// stmtCache lazily prepares statements and reuses them by SQL text.
+type stmtCache struct {
+	mu    sync.Mutex
+	stmts map[string]*sql.Stmt
+}
+
+func newStmtCache() *stmtCache {
+	return &stmtCache{stmts: make(map[string]*sql.Stmt)}
+}
+
+func (sc *stmtCache) prepare(ctx context.Context, query string) (*sql.Stmt, error) {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	if stmt, ok := sc.stmts[query]; ok {
+		return stmt, nil
+	}
+	stmt, err := db.PrepareContext(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	sc.stmts[query] = stmt
+	return stmt, nil
+}
+
+func (sc *stmtCache) close() {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	for query, stmt := range sc.stmts {
+		if err := stmt.Close(); err != nil {
+			log.Printf("failed to close statement %q: %v", query, err)
+		}
+		delete(sc.stmts, query)
+	}
+}
+
+// queryContext, queryRowContext and execContext go through the statement
+// cache when it is enabled and straight to db otherwise. Every handler query
+// uses them except /debug/explain, whose plans are one-off diagnostics. The
+// gauge refresh also goes straight to db: it runs in the background and may
+// outlive the cache during shutdown.
+func queryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error) {
+	if stmts == nil {
+		return db.QueryContext(ctx, query, args...)
+	}
+	stmt, err := stmts.prepare(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	return stmt.QueryContext(ctx, args...)
+}
+
+func queryRowContext(ctx context.Context, query string, args ...interface{}) rowScanner {
+	if stmts == nil {
+		return db.QueryRowContext(ctx, query, args...)
+	}
+	stmt, err := stmts.prepare(ctx, query)
+	if err != nil {
+		return errRow{err}
+	}
+	return stmt.QueryRowContext(ctx, args...)
+}
+
+// errRow reports a failed prepare from Scan, like *sql.Row does for a failed
+// query.
+type errRow struct {
+	err error
+}
+
+func (r errRow) Scan(...interface{}) error {
+	return r.err
+}
+
+func execContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error) {
+	if stmts == nil {
+		return db.ExecContext(ctx, query, args...)
+	}
+	stmt, err := stmts.prepare(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	return stmt.ExecContext(ctx, args...)
+}
+
+// trackedTx keeps db_active_transactions accurate. The gauge is decremented
+// once, by whichever of Commit or Rollback runs first, so the usual deferred
+// Rollback covers every exit path.
+type trackedTx struct {
+	*sql.Tx
+	once sync.Once
+}
+
+type poolExhaustedKey struct{}
+
+// checkPoolExhausted counts err as pool exhaustion when the context expired
+// while every connection was in use, and flags the request for detectPoolBusy.
+func checkPoolExhausted(ctx context.Context, err error) {
+	if !errors.Is(err, context.DeadlineExceeded) {
+		return
+	}
+	stats := db.Stats()
+	if stats.MaxOpenConnections == 0 || stats.InUse < stats.MaxOpenConnections {
+		return
+	}
+	dbPoolExhausted.Inc()
+	if flag, ok := ctx.Value(poolExhaustedKey{}).(*atomic.Bool); ok {
+		flag.Store(true)
+	}
+}
+
+// detectPoolBusy bounds each request by timeout, if set, and answers requests
+// whose database work could not get a connection in time with 503 instead of
+// the handler's generic error.
+func detectPoolBusy(timeout time.Duration) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			flag := new(atomic.Bool)
+			ctx := context.WithValue(c.Request().Context(), poolExhaustedKey{}, flag)
+			if timeout > 0 {
+				var cancel context.CancelFunc
+				ctx, cancel = context.WithTimeout(ctx, timeout)
+				defer cancel()
+			}
+			c.SetRequest(c.Request().WithContext(ctx))
+
+			err := next(c)
+			if err != nil && flag.Load() {
+				return echo.NewHTTPError(http.StatusServiceUnavailable, "service busy, retry later")
+			}
+			return err
+		}
+	}
+}
+
+func beginTx(ctx context.Context) (*trackedTx, error) {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		checkPoolExhausted(ctx, err)
+		return nil, err
+	}
+	dbActiveTx.Inc()
+	return &trackedTx{Tx: tx}, nil
+}
+
+// execContext runs query in the transaction, through the statement cache when
+// it is enabled. Stmt reuses the cached statement when it was already prepared
+// on the transaction's connection.
+func (t *trackedTx) execContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error) {
+	if stmts == nil {
+		return t.ExecContext(ctx, query, args...)
+	}
+	stmt, err := stmts.prepare(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	return t.StmtContext(ctx, stmt).ExecContext(ctx, args...)
+}
+
+func (t *trackedTx) Commit() error {
+	defer t.once.Do(dbActiveTx.Dec)
+	return t.Tx.Commit()
+}
+
+func (t *trackedTx) Rollback() error {
+	defer t.once.Do(dbActiveTx.Dec)
+	return t.Tx.Rollback()
+}
+
+func isDescriptionTooLong(err error) bool {
+	var sqliteErr sqlite3.Error
+	return errors.As(err, &sqliteErr) && sqliteErr.ExtendedCode == sqlite3.ErrConstraintTrigger &&
+		strings.Contains(sqliteErr.Error(), errDescriptionTooLong)
+}
+
+func isUniqueViolation(err error) bool {
+	var sqliteErr sqlite3.Error
+	return errors.As(err, &sqliteErr) && sqliteErr.ExtendedCode == sqlite3.ErrConstraintUnique
+}
+
+func getTodos(c echo.Context) error {
+	if c.QueryParam("modified_since") != "" {
+		return getTodosModifiedSince(c)
+	}
+
+	ctx, span := tracer.Start(c.Request().Context(), "getTodos")
+	defer span.End()
+
+	version, changed := todoChanges.current()
+	if v := c.QueryParam("wait"); v != "" {
+		wait, err := time.ParseDuration(v)
+		if err != nil || wait < 0 {
+			return echo.NewHTTPError(http.StatusBadRequest, "wait must be a non-negative duration")
+		}
+		wait = min(wait, maxLongPollWait)
+		// The wait ends with a quarter of any REQUEST_TIMEOUT left for the
+		// list query, so an unchanged list is still served and ctx.Done only
+		// fires when the client goes away.
+		if deadline, ok := ctx.Deadline(); ok {
+			wait = min(wait, time.Until(deadline)*3/4)
+		}
+
+		// A client that is behind gets the current list straight away.
+		if since := c.QueryParam("version"); since == "" || since == strconv.FormatUint(version, 10) {
+			timer := time.NewTimer(wait)
+			defer timer.Stop()
+			select {
+			case <-changed:
+			case <-timer.C:
+			case <-longPolls.done():
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+			version, _ = todoChanges.current()
+		}
+	}
+
+	todos, err := listTodos(ctx, version)
+	if err != nil {
+		return err
+	}
+
+	requestCount.WithLabelValues(http.MethodGet, "/todos").Inc()
+	c.Response().Header().Set("X-Todos-Version", strconv.FormatUint(version, 10))
+	c.Response().Header().Add(echo.HeaderVary, echo.HeaderAccept)
+	// The counts come from the list itself so they always match the body.
+	completed := 0
+	for _, todo := range todos {
+		if todo.Completed {
+			completed++
+		}
+	}
+	setCountHeaders(c, len(todos), completed)
+	if acceptsJSONAPI(c.Request().Header.Get(echo.HeaderAccept)) {
+		c.Response().Header().Set(echo.HeaderContentType, mimeJSONAPI)
+		return writeJSON(c, http.StatusOK, jsonAPITodos(todos))
+	}
+	return writeJSON(c, http.StatusOK, todos)
+}
+
+// listTodos returns every todo, pinned first, from listCache when it holds
+// the list as of version.
+func listTodos(ctx context.Context, version uint64) ([]TodoItem, error) {
+	if cached, ok := listCache.get("todos", version); ok {
+		return cached.([]TodoItem), nil
+	}
+
+	query := "SELECT " + todoColumns + " FROM todos ORDER BY pinned DESC, id"
+	dbCtx, done := traceDB(ctx, "SELECT", query)
+	rows, err := queryContext(dbCtx, query)
+	done(err)
+	if err != nil {
+		return nil, echo.NewHTTPError(http.StatusInternalServerError, "failed to query todos")
+	}
+	defer rows.Close()
+
+	todos := []TodoItem{}
+	for rows.Next() {
+		todo, err := scanTodo(rows)
+		if err != nil {
+			return nil, echo.NewHTTPError(http.StatusInternalServerError, "failed to scan row")
+		}
+		todos = append(todos, todo)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, echo.NewHTTPError(http.StatusInternalServerError, "failed to read todos")
+	}
+
+	listCache.put("todos", version, todos)
+	return todos, nil
+}
+
+const mimeJSONAPI = "application/vnd.api+json"
+
+// jsonAPIResource is a jsonapi.org resource object.
+type jsonAPIResource struct {
+	Type       string      `json:"type"`
+	ID         string      `json:"id"`
+	Attributes interface{} `json:"attributes"`
+}
+
+type todoAttributes struct {
+	Title       string  `json:"title"`
+	Description *string `json:"description,omitempty"`
+	Completed   bool    `json:"completed"`
+	Status      string  `json:"status,omitempty"`
+	Pinned      bool    `json:"pinned"`
+}
+
+func jsonAPITodos(todos []TodoItem) map[string][]jsonAPIResource {
+	data := make([]jsonAPIResource, 0, len(todos))
+	for _, todo := range todos {
+		data = append(data, jsonAPIResource{
+			Type: "todos",
+			ID:   strconv.Itoa(todo.ID),
+			Attributes: todoAttributes{
+				Title:       todo.Title,
+				Description: todo.Description,
+				Completed:   todo.Completed,
+				Status:      todo.Status,
+				Pinned:      todo.Pinned,
+			},
+		})
+	}
+	return map[string][]jsonAPIResource{"data": data}
+}
+
+func acceptsJSONAPI(accept string) bool {
+	for _, part := range strings.Split(accept, ",") {
+		if mediaType, _, err := mime.ParseMediaType(part); err == nil && mediaType == mimeJSONAPI {
+			return true
+		}
+	}
+	return false
+}
+
+// sqliteTimeLayout matches the text SQLite's CURRENT_TIMESTAMP produces.
+const sqliteTimeLayout = "2006-01-02 15:04:05"
+
+// sqliteNow stamps writes to the millisecond, in sqliteMillisLayout, so sync
+// cutoffs order correctly within a second. As text it still sorts after a
+// whole-second CURRENT_TIMESTAMP of the same second.
+const (
+	sqliteNow          = "strftime('%Y-%m-%d %H:%M:%f', 'now')"
+	sqliteMillisLayout = "2006-01-02 15:04:05.000"
+)
+
+// getTodosModifiedSince returns the todos written and the ids deleted at or
+// after the modified_since cutoff, so sync clients can pull deltas. Changes
+// in the cutoff's own millisecond are sent again on the next pull, so clients
+// should apply them by id.
+func getTodosModifiedSince(c echo.Context) error {
+	ctx, span := tracer.Start(c.Request().Context(), "getTodosModifiedSince")
+	defer span.End()
+
+	since, err := time.Parse(time.RFC3339, c.QueryParam("modified_since"))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "modified_since must be an RFC3339 timestamp")
+	}
+	cutoff := since.UTC().Format(sqliteMillisLayout)
+	span.SetAttributes(attribute.String("todo.modified_since", since.Format(time.RFC3339)))
+
+	query := "SELECT " + todoColumns + " FROM todos WHERE updated_at >= ? ORDER BY updated_at"
+	dbCtx, done := traceDB(ctx, "SELECT", query)
+	rows, err := queryContext(dbCtx, query, cutoff)
+	done(err)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to query todos")
+	}
+	defer rows.Close()
+
+	todos := []TodoItem{}
+	for rows.Next() {
+		todo, err := scanTodo(rows)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to scan row")
+		}
+		todos = append(todos, todo)
+	}
+	if err := rows.Err(); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to read todos")
+	}
+
+	query = "SELECT todo_id FROM todo_tombstones WHERE deleted_at >= ? ORDER BY seq"
+	dbCtx, done = traceDB(ctx, "SELECT", query)
+	tombstones, err := queryContext(dbCtx, query, cutoff)
+	done(err)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to query tombstones")
+	}
+	defer tombstones.Close()
+
+	deleted := []int{}
+	for tombstones.Next() {
+		var id int
+		if err := tombstones.Scan(&id); err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to scan row")
+		}
+		deleted = append(deleted, id)
+	}
+	if err := tombstones.Err(); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to read tombstones")
+	}
+
+	requestCount.WithLabelValues(http.MethodGet, "/todos").Inc()
+	return writeJSON(c, http.StatusOK, map[string]interface{}{"todos": todos, "deleted": deleted})
+}
+
+// exportContentTypes lists the supported export formats.
+var exportContentTypes = map[string]string{
+	"json":   echo.MIMEApplicationJSONCharsetUTF8,
+	"csv":    "text/csv; charset=utf-8",
+	"ndjson": "application/x-ndjson",
+}
+
+func exportTodos(c echo.Context) error {
+	ctx, span := tracer.Start(c.Request().Context(), "exportTodos")
+	defer span.End()
+	defer recordAllocs(span)()
+
+	format := c.QueryParam("format")
+	if format == "" {
+		format = "json"
+	}
+	contentType, ok := exportContentTypes[format]
+	if !ok {
+		return echo.NewHTTPError(http.StatusBadRequest, "format must be json, csv or ndjson")
+	}
+	compress := false
+	if v := c.QueryParam("gzip"); v != "" {
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusBadRequest, "gzip must be true or false")
+		}
+		compress = b
+	}
+	span.SetAttributes(attribute.String("export.format", format), attribute.Bool("export.gzip", compress))
+
+	query := "SELECT " + todoColumns + " FROM todos ORDER BY id"
+	dbCtx, done := traceDB(ctx, "SELECT", query)
+	rows, err := queryContext(dbCtx, query)
+	done(err)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to query todos")
+	}
+	defer rows.Close()
+
+	res := c.Response()
+	res.Header().Set(echo.HeaderContentType, contentType)
+	res.Header().Set(echo.HeaderContentDisposition, fmt.Sprintf(`attachment; filename="todos.%s"`, format))
+	requestCount.WithLabelValues(http.MethodGet, "/todos/export").Inc()
+	// Byte ranges of a compressed stream are not useful, so gzip exports are
+	// always streamed in full.
+	if c.Request().Header.Get("Range") != "" && !compress {
+		return serveBufferedExport(c, format, rows)
+	}
+
+	if compress {
+		res.Header().Set(echo.HeaderContentEncoding, "gzip")
+	}
+	res.WriteHeader(http.StatusOK)
+	// The status is already sent, so a failure here can only cut the body short.
+	if err := writeCompressedExport(res, format, rows, compress); err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		log.Printf("export failed: %v", err)
+	}
+	return nil
+}
+
+// recordAllocs returns a func that sets the heap allocated since the call as
+// span attributes. It does nothing unless traceMemStats is enabled.
+func recordAllocs(span trace.Span) func() {
+	if !traceMemStats {
+		return func() {}
+	}
+	var before runtime.MemStats
+	runtime.ReadMemStats(&before)
+	return func() {
+		var after runtime.MemStats
+		runtime.ReadMemStats(&after)
+		span.SetAttributes(
+			attribute.Int64("memory.alloc_bytes", int64(after.TotalAlloc-before.TotalAlloc)),
+			attribute.Int64("memory.mallocs", int64(after.Mallocs-before.Mallocs)),
+		)
+	}
+}
+
+// serveBufferedExport writes the export to a temp file so http.ServeContent can
+// answer Range requests. The ETag is a content hash, letting clients resume
+// with If-Range only while the export is unchanged.
+func serveBufferedExport(c echo.Context, format string, rows *sql.Rows) error {
+	f, err := os.CreateTemp("", "todos-export-*")
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to create export file")
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	hash := sha256.New()
+	if err := writeExport(io.MultiWriter(f, hash), format, rows); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to write export")
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to read export file")
+	}
+
+	c.Response().Header().Set("ETag", `"`+hex.EncodeToString(hash.Sum(nil))+`"`)
+	http.ServeContent(c.Response(), c.Request(), "", time.Time{}, f)
+	return nil
+}
+
+// writeCompressedExport streams the export through gzip when compress is set.
+// Closing the gzip writer writes the trailer before the response is flushed.
+func writeCompressedExport(res *echo.Response, format string, rows *sql.Rows, compress bool) error {
+	if !compress {
+		return writeExport(res, format, rows)
+	}
+	gz := gzip.NewWriter(res)
+	if err := writeExport(gz, format, rows); err != nil {
+		gz.Close()
+		return err
+	}
+	if err := gz.Close(); err != nil {
+		return err
+	}
+	res.Flush()
+	return nil
+}
+
+// writeExport streams rows to w one todo at a time in the given format.
+func writeExport(w io.Writer, format string, rows *sql.Rows) error {
+	var csvWriter *csv.Writer
+	enc := json.NewEncoder(w)
+	switch format {
+	case "json":
+		if _, err := io.WriteString(w, "["); err != nil {
+			return err
+		}
+	case "csv":
+		csvWriter = csv.NewWriter(w)
+		if err := csvWriter.Write([]string{"id", "title", "description", "completed", "status", "pinned"}); err != nil {
+			return err
+		}
+	}
+
+	for n := 0; rows.Next(); n++ {
+		todo, err := scanTodo(rows)
+		if err != nil {
+			return err
+		}
+		switch format {
+		case "json":
+			if n > 0 {
+				if _, err := io.WriteString(w, ","); err != nil {
+					return err
+				}
+			}
+			err = enc.Encode(jsonFields(todo))
+		case "ndjson":
+			err = enc.Encode(jsonFields(todo))
+		case "csv":
+			err = csvWriter.Write([]string{
+				strconv.Itoa(todo.ID), todo.Title, todo.descriptionOrEmpty(),
+				strconv.FormatBool(todo.Completed), todo.Status, strconv.FormatBool(todo.Pinned),
+			})
+		}
+		if err != nil {
+			return err
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	switch format {
+	case "json":
+		_, err := io.WriteString(w, "]\n")
+		return err
+	case "csv":
+		csvWriter.Flush()
+		return csvWriter.Error()
+	}
+	return nil
+}
+
+func countTodos(c echo.Context) error {
+	ctx, span := tracer.Start(c.Request().Context(), "countTodos")
+	defer span.End()
+
+	var total, completed int
+	query := "SELECT COUNT(*), COUNT(*) FILTER (WHERE completed) FROM todos"
+	dbCtx, done := traceDB(ctx, "SELECT", query)
+	err := queryRowContext(dbCtx, query).Scan(&total, &completed)
+	done(err)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to count todos")
+	}
+
+	requestCount.WithLabelValues(http.MethodHead, "/todos").Inc()
+	setCountHeaders(c, total, completed)
+	return c.NoContent(http.StatusOK)
+}
+
+func setCountHeaders(c echo.Context, total, completed int) {
+	h := c.Response().Header()
+	h.Set("X-Total-Count", strconv.Itoa(total))
+	h.Set("X-Completed-Count", strconv.Itoa(completed))
+	h.Set("X-Pending-Count", strconv.Itoa(total-completed))
+}
+
+// boardLimit parses the board limit parameter name, returning fallback when
+// it is absent.
+func boardLimit(c echo.Context, name string, fallback int) (int, error) {
+	v := c.QueryParam(name)
+	if v == "" {
+		return fallback, nil
+	}
+	n, err := strconv.ParseInt(v, 10, 32)
+	if err != nil || n < 1 || n > maxPageSize {
+		return 0, echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("%s must be between 1 and %d", name, maxPageSize))
+	}
+	return int(n), nil
+}
+
+func getTodoBoard(c echo.Context) error {
+	ctx, span := tracer.Start(c.Request().Context(), "getTodoBoard")
+	defer span.End()
+
+	// limit applies to both columns unless pending_limit or completed_limit
+	// overrides it; 0 leaves a column unlimited.
+	limit, err := boardLimit(c, "limit", 0)
+	if err != nil {
+		return err
+	}
+	pendingLimit, err := boardLimit(c, "pending_limit", limit)
+	if err != nil {
+		return err
+	}
+	completedLimit, err := boardLimit(c, "completed_limit", limit)
+	if err != nil {
+		return err
+	}
+
+	version, _ := todoChanges.current()
+	key := fmt.Sprintf("board?pending_limit=%d&completed_limit=%d", pendingLimit, completedLimit)
+	if cached, ok := listCache.get(key, version); ok {
+		requestCount.WithLabelValues(http.MethodGet, "/todos/board").Inc()
+		return writeJSON(c, http.StatusOK, cached)
+	}
+
+	// Rows are numbered within their column so the limits are applied by
+	// SQLite and only the rows on the board are read.
+	query := `SELECT ` + todoColumns + ` FROM (
+		SELECT ` + todoColumns + `,
+			ROW_NUMBER() OVER (PARTITION BY completed ORDER BY id) AS position,
+			CASE WHEN completed THEN ? ELSE ? END AS column_limit
+		FROM todos
+	) WHERE column_limit = 0 OR position <= column_limit ORDER BY id`
+	dbCtx, done := traceDB(ctx, "SELECT", query)
+	rows, err := queryContext(dbCtx, query, completedLimit, pendingLimit)
+	done(err)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to query todos")
+	}
+	defer rows.Close()
+
+	board := map[string][]TodoItem{
+		"pending":   {},
+		"completed": {},
+	}
+	for rows.Next() {
+		todo, err := scanTodo(rows)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to scan row")
+		}
+		column := "pending"
+		if todo.Completed {
+			column = "completed"
+		}
+		board[column] = append(board[column], todo)
+	}
+	if err := rows.Err(); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to read todos")
+	}
+
+	listCache.put(key, version, board)
+	requestCount.WithLabelValues(http.MethodGet, "/todos/board").Inc()
+	return writeJSON(c, http.StatusOK, board)
+}
+
+func createTodo(c echo.Context) error {
+	ctx, span := tracer.Start(c.Request().Context(), "createTodo")
+	defer span.End()
+
+	var todo TodoItem
+	if err := c.Bind(&todo); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "invalid request body")
+	}
+	todo.Title = normalizeTitle(todo.Title)
+	if err := validateTodo(todo); err != nil {
+		return err
+	}
+	resolveStatus(&todo, "")
+
+	var err error
+	if createDedupe != nil {
+		var duplicate bool
+		todo, duplicate, err = createDedupe.do(todo.dedupeKey(), func() (TodoItem, error) {
+			return insertTodo(ctx, todo)
+		})
+		if err == nil && duplicate {
+			span.SetAttributes(attribute.Bool("todo.deduplicated", true))
+			requestCount.WithLabelValues(http.MethodPost, "/todos").Inc()
+			return writeJSON(c, http.StatusCreated, todo)
+		}
+	} else {
+		todo, err = insertTodo(ctx, todo)
+	}
+	if err != nil {
+		return err
+	}
+
+	todoChanges.notify()
+	recordTodoAction(actionCreated)
+	requestCount.WithLabelValues(http.MethodPost, "/todos").Inc()
+	return writeJSON(c, http.StatusCreated, todo)
+}
+
+func insertTodo(ctx context.Context, todo TodoItem) (TodoItem, error) {
+	query := `INSERT INTO todos (title, description, completed, status, pinned, created_at, updated_at)
+		VALUES (?, ?, ?, ?, ?, ` + sqliteNow + `, ` + sqliteNow + `)`
+	dbCtx, done := traceDB(ctx, "INSERT", query)
+	result, err := execContext(dbCtx, query,
+		todo.Title, todo.Description, todo.Completed, todo.Status, todo.Pinned)
+	done(err)
+	if isUniqueViolation(err) {
+		return todo, echo.NewHTTPError(http.StatusConflict, "todo with this title already exists")
+	}
+	if isDescriptionTooLong(err) {
+		return todo, &validationError{fields: map[string]string{"description": errDescriptionTooLong}}
+	}
+	if err != nil {
+		return todo, echo.NewHTTPError(http.StatusInternalServerError, "failed to insert todo")
+	}
+
+	id, _ := result.LastInsertId()
+	todo.ID = int(id)
+	return todo, nil
+}
+
+// responseCache is an LRU of list responses keyed by their normalized query.
+// Entries carry the todoChanges version they were read at, and any newer
+// version empties the whole cache, so every mutation invalidates it. A nil
+// cache never hits.
+type responseCache struct {
+	ttl     time.Duration
+	max     int
+	mu      sync.Mutex
+	version uint64
+	order   *list.List // most recently used first
+	entries map[string]*list.Element
+}
+
+type responseCacheEntry struct {
+	key     string
+	value   interface{}
+	expires time.Time
+}
+
+func newResponseCache(max int, ttl time.Duration) *responseCache {
+	return &responseCache{ttl: ttl, max: max, order: list.New(), entries: make(map[string]*list.Element)}
+}
+
+// sync drops every entry once version has moved past the cached one. It must
+// be called with rc.mu held.
+func (rc *responseCache) sync(version uint64) {
+	if version > rc.version {
+		rc.version = version
+		rc.order.Init()
+		clear(rc.entries)
+	}
+}
+
+func (rc *responseCache) get(key string, version uint64) (interface{}, bool) {
+	if rc == nil {
+		return nil, false
+	}
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	defer rc.report()
+
+	rc.sync(version)
+	el, ok := rc.entries[key]
+	if !ok || version < rc.version {
+		return nil, false
+	}
+	entry := el.Value.(*responseCacheEntry)
+	if time.Now().After(entry.expires) {
+		rc.order.Remove(el)
+		delete(rc.entries, key)
+		return nil, false
+	}
+	rc.order.MoveToFront(el)
+	return entry.value, true
+}
+
+func (rc *responseCache) put(key string, version uint64, value interface{}) {
+	if rc == nil {
+		return
+	}
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	defer rc.report()
+
+	rc.sync(version)
+	// A response read before the latest mutation is already stale.
+	if version < rc.version {
+		return
+	}
+	entry := &responseCacheEntry{key: key, value: value, expires: time.Now().Add(rc.ttl)}
+	if el, ok := rc.entries[key]; ok {
+		el.Value = entry
+		rc.order.MoveToFront(el)
+		return
+	}
+	rc.entries[key] = rc.order.PushFront(entry)
+	for rc.order.Len() > rc.max {
+		oldest := rc.order.Back()
+		rc.order.Remove(oldest)
+		delete(rc.entries, oldest.Value.(*responseCacheEntry).key)
+	}
+}
+
+func (rc *responseCache) report() {
+	listCacheEntries.Set(float64(rc.order.Len()))
+}
+
+// createDeduper collapses identical create payloads arriving within window
+// into the result of the first one, guarding against double submits.
+type createDeduper struct {
+	window time.Duration
+	mu     sync.Mutex
+	recent map[string]dedupeEntry
+}
+
+type dedupeEntry struct {
+	todo    TodoItem
+	expires time.Time
+}
+
+func newCreateDeduper(window time.Duration) *createDeduper {
+	return &createDeduper{window: window, recent: make(map[string]dedupeEntry)}
+}
+
+// do returns the remembered todo for key if one is still within the window,
+// and otherwise runs create and remembers its result. Creates are serialized
+// so concurrent duplicates also collapse.
+func (d *createDeduper) do(key string, create func() (TodoItem, error)) (TodoItem, bool, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	now := time.Now()
+	for k, entry := range d.recent {
+		if now.After(entry.expires) {
+			delete(d.recent, k)
+		}
+	}
+	if entry, ok := d.recent[key]; ok {
+		return entry.todo, true, nil
+	}
+
+	todo, err := create()
+	if err != nil {
+		return todo, false, err
+	}
+	d.recent[key] = dedupeEntry{todo: todo, expires: now.Add(d.window)}
+	return todo, false, nil
+}
+
+// upsertStatus is the status an upsert stores over an existing row. ?4 is the
+// status resolved as for a new todo and ?6 is keepInProgress.
+const upsertStatus = `(CASE WHEN ?6 AND todos.status = 'in_progress' THEN 'in_progress' ELSE ?4 END)`
+
+// statusTransitionPairs renders statusTransitions as SQL row values for an IN
+// list, e.g. ('todo', 'done'), ...
+func statusTransitionPairs() string {
+	var pairs []string
+	for from, tos := range statusTransitions {
+		for _, to := range tos {
+			pairs = append(pairs, fmt.Sprintf("('%s', '%s')", from, to))
+		}
+	}
+	slices.Sort(pairs)
+	return strings.Join(pairs, ", ")
+}
+
+func upsertTodo(c echo.Context) error {
+	ctx, span := tracer.Start(c.Request().Context(), "upsertTodo")
+	defer span.End()
+
+	if c.QueryParam("by") != "title" {
+		return echo.NewHTTPError(http.StatusBadRequest, "upsert requires by=title")
+	}
+	// The upsert relies on the unique title index to find its row.
+	if !uniqueTitles {
+		return echo.NewHTTPError(http.StatusBadRequest, "upsert by title requires UNIQUE_TITLES")
+	}
+
+	var todo TodoItem
+	if err := c.Bind(&todo); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "invalid request body")
+	}
+	todo.Title = normalizeTitle(todo.Title)
+	if err := validateTodo(todo); err != nil {
+		return err
+	}
+
+	// An existing row keeps an in-progress status unless the request names a
+	// status or completes it, like resolveStatus does.
+	keepInProgress := todo.Status == "" && !todo.Completed
+	resolveStatus(&todo, "")
+
+	// One statement inserts or updates, so concurrent first writes of a title
+	// cannot both insert. An update that breaks the status transitions
+	// matches no row and returns nothing.
+	query := `INSERT INTO todos (title, description, completed, status, pinned, created_at, updated_at)
+		VALUES (?1, ?2, ?3, ?4, ?5, ` + sqliteNow + `, ` + sqliteNow + `)
+		ON CONFLICT(title) DO UPDATE SET
+			description = excluded.description,
+			status = ` + upsertStatus + `,
+			completed = ` + upsertStatus + ` = 'done',
+			revision = revision + 1,
+			updated_at = ` + sqliteNow + `
+		WHERE ` + upsertStatus + ` = todos.status OR (todos.status, ` + upsertStatus + `) IN (` + statusTransitionPairs() + `)
+		RETURNING id, completed, status, pinned, revision = 0`
+	var created bool
+	dbCtx, done := traceDB(ctx, "UPSERT", query)
+	err := queryRowContext(dbCtx, query, todo.Title, todo.Description, todo.Completed, todo.Status, todo.Pinned, keepInProgress).
+		Scan(&todo.ID, &todo.Completed, &todo.Status, &todo.Pinned, &created)
+	if errors.Is(err, sql.ErrNoRows) {
+		done(nil)
+		var current string
+		if err := queryRowContext(ctx, "SELECT status FROM todos WHERE title = ?", todo.Title).Scan(&current); err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to query todo")
+		}
+		return echo.NewHTTPError(http.StatusConflict,
+			fmt.Sprintf("cannot change status from %s to %s", current, todo.Status))
+	}
+	done(err)
+	if isDescriptionTooLong(err) {
+		return &validationError{fields: map[string]string{"description": errDescriptionTooLong}}
+	}
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to upsert todo")
+	}
+	todoChanges.notify()
+
+	requestCount.WithLabelValues(http.MethodPut, "/todos").Inc()
+	if created {
+		recordTodoAction(actionCreated)
+		return writeJSON(c, http.StatusCreated, todo)
+	}
+	recordTodoAction(actionUpdated)
+	return writeJSON(c, http.StatusOK, todo)
+}
+
+func pinTodo(c echo.Context) error {
+	return setPinned(c, true)
+}
+
+func unpinTodo(c echo.Context) error {
+	return setPinned(c, false)
+}
+
+func setPinned(c echo.Context, pinned bool) error {
+	ctx, span := tracer.Start(c.Request().Context(), "setPinned")
+	defer span.End()
+	span.SetAttributes(attribute.Bool("todo.pinned", pinned))
+
+	query := "UPDATE todos SET pinned = ?, updated_at = " + sqliteNow + " WHERE id = ? RETURNING " + todoColumns
+	dbCtx, done := traceDB(ctx, "UPDATE", query)
+	todo, err := scanTodo(queryRowContext(dbCtx, query, pinned, c.Param("id")))
+	if errors.Is(err, sql.ErrNoRows) {
+		done(nil)
+		return echo.NewHTTPError(http.StatusNotFound, "todo not found")
+	}
+	done(err)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to update todo")
+	}
+	todoChanges.notify()
+
+	if pinned {
+		recordTodoAction(actionPinned)
+		requestCount.WithLabelValues(http.MethodPost, "/todos/:id/pin").Inc()
+	} else {
+		recordTodoAction(actionUnpinned)
+		requestCount.WithLabelValues(http.MethodDelete, "/todos/:id/pin").Inc()
+	}
+	return writeJSON(c, http.StatusOK, todo)
+}
+
+func deleteTodo(c echo.Context) error {
+	ctx, span := tracer.Start(c.Request().Context(), "deleteTodo")
+	defer span.End()
+
+	id := c.Param("id")
+	tx, err := beginTx(ctx)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to begin transaction")
+	}
+	defer tx.Rollback()
+
+	query := "DELETE FROM todos WHERE id = ?"
+	dbCtx, done := traceDB(ctx, "DELETE", query)
+	result, err := tx.execContext(dbCtx, query, id)
+	done(err)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to delete todo")
+	}
+	// Repeated deletes of the same id must not record extra tombstones.
+	deleted, _ := result.RowsAffected()
+	if deleted > 0 {
+		query = "INSERT INTO todo_tombstones (todo_id, deleted_at) VALUES (?, " + sqliteNow + ")"
+		dbCtx, done := traceDB(ctx, "INSERT", query)
+		_, err := tx.execContext(dbCtx, query, id)
+		done(err)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to record tombstone")
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit transaction")
+	}
+	if deleted > 0 {
+		todoChanges.notify()
+	}
+
+	recordTodoAction(actionDeleted)
+	requestCount.WithLabelValues(http.MethodDelete, "/todos/:id").Inc()
+	return c.NoContent(http.StatusNoContent)
+}
+
+func getDeletedTodos(c echo.Context) error {
+	ctx, span := tracer.Start(c.Request().Context(), "getDeletedTodos")
+	defer span.End()
+
+	since := int64(0)
+	if v := c.QueryParam("since"); v != "" {
+		n, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || n < 0 {
+			return echo.NewHTTPError(http.StatusBadRequest, "since must be a non-negative cursor")
+		}
+		since = n
+	}
+
+	query := "SELECT seq, todo_id FROM todo_tombstones WHERE seq > ? ORDER BY seq"
+	dbCtx, done := traceDB(ctx, "SELECT", query)
+	rows, err := queryContext(dbCtx, query, since)
+	done(err)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to query tombstones")
+	}
+	defer rows.Close()
+
+	ids := []int{}
+	cursor := since
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&cursor, &id); err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to scan row")
+		}
+		ids = append(ids, id)
+	}
+	if err := rows.Err(); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to read tombstones")
+	}
+
+	requestCount.WithLabelValues(http.MethodGet, "/todos/deleted").Inc()
+	return writeJSON(c, http.StatusOK, map[string]interface{}{"ids": ids, "cursor": cursor})
+}
+
+// parseAge parses a duration, also accepting whole days such as "30d".
+func parseAge(v string) (time.Duration, error) {
+	if days, ok := strings.CutSuffix(v, "d"); ok {
+		n, err := strconv.Atoi(days)
+		if err != nil {
+			return 0, err
+		}
+		return time.Duration(n) * 24 * time.Hour, nil
+	}
+	return time.ParseDuration(v)
+}
+
+// purgeTombstones permanently removes deletion records older than
+// older_than. Clients syncing from a cursor before the purge miss them.
+func purgeTombstones(c echo.Context) error {
+	ctx, span := tracer.Start(c.Request().Context(), "purgeTombstones")
+	defer span.End()
+
+	age, err := parseAge(c.QueryParam("older_than"))
+	if err != nil || age <= 0 {
+		return echo.NewHTTPError(http.StatusBadRequest, "older_than must be a positive duration such as 30d or 12h")
+	}
+	cutoff := time.Now().Add(-age).UTC().Format(sqliteTimeLayout)
+	span.SetAttributes(attribute.String("gc.cutoff", cutoff))
+
+	tx, err := beginTx(ctx)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to begin transaction")
+	}
+	defer tx.Rollback()
+
+	query := "DELETE FROM todo_tombstones WHERE deleted_at < ?"
+	dbCtx, done := traceDB(ctx, "DELETE", query)
+	result, err := tx.execContext(dbCtx, query, cutoff)
+	done(err)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to purge tombstones")
+	}
+	if err := tx.Commit(); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit transaction")
+	}
+
+	purged, _ := result.RowsAffected()
+	span.SetAttributes(attribute.Int64("gc.purged", purged))
+	return writeJSON(c, http.StatusOK, map[string]int64{"purged": purged})
+}
+
+// acceptsKnownMetricsFormat reports whether the Accept header names a format
+// promhttp can negotiate on its own.
+func acceptsKnownMetricsFormat(accept string) bool {
+	for _, part := range strings.Split(accept, ",") {
+		mediaType, _, err := mime.ParseMediaType(part)
+		if err != nil {
+			continue
+		}
+		switch mediaType {
+		case "text/plain", expfmt.OpenMetricsType, expfmt.ProtoType:
+			return true
+		}
+	}
+	return false
+}
+
+// metricsHandler serves gatherer, defaulting to OpenMetrics when defaultFormat
+// is "openmetrics" and to the classic text format otherwise.
+func metricsHandler(gatherer prometheus.Gatherer, defaultFormat string) echo.HandlerFunc {
+	openMetrics := defaultFormat == "openmetrics"
+
+	promHandler := promhttp.InstrumentMetricHandler(prometheus.DefaultRegisterer,
+		promhttp.HandlerFor(gatherer, promhttp.HandlerOpts{
+			EnableOpenMetrics: openMetrics,
+			ErrorLog:          log.Default(),
+		}))
+
+	return func(c echo.Context) error {
+		req := c.Request()
+		// promhttp already falls back to the classic text format.
+		if openMetrics && !acceptsKnownMetricsFormat(req.Header.Get(echo.HeaderAccept)) {
+			req.Header.Set(echo.HeaderAccept, expfmt.OpenMetricsType+"; version="+expfmt.OpenMetricsVersion_1_0_0)
+		}
+		promHandler.ServeHTTP(c.Response(), req)
+		return nil
+	}
+}
+
+// gatherMetrics gathers g and logs any error. Any error, including a panicking
+// collector caught by recoveringCollector, fails the whole gather instead of
+// serving partial data.
+func gatherMetrics(g prometheus.Gatherer) ([]*dto.MetricFamily, error) {
+	families, err := g.Gather()
+	if err != nil {
+		log.Printf("failed to gather metrics: %v", err)
+	}
+	return families, err
+}
+
+func statsHandler(c echo.Context) error {
+	families, err := gatherMetrics(appRegistry)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to gather metrics")
+	}
+
+	stats := make(map[string]float64, len(statsMetrics))
+	for _, name := range statsMetrics {
+		stats[name] = 0
+	}
+	for _, mf := range families {
+		if _, ok := stats[mf.GetName()]; !ok {
+			continue
+		}
+		// Labelled series are summed so each entry is a single total.
+		for _, m := range mf.GetMetric() {
+			switch mf.GetType() {
+			case dto.MetricType_COUNTER:
+				stats[mf.GetName()] += m.GetCounter().GetValue()
+			case dto.MetricType_GAUGE:
+				stats[mf.GetName()] += m.GetGauge().GetValue()
+			}
+		}
+	}
+
+	return writeJSON(c, http.StatusOK, stats)
+}
+
+type errorResponse struct {
+	Code    string            `json:"code"`
+	Message string            `json:"message"`
+	Fields  map[string]string `json:"fields,omitempty"`
+	TraceID string            `json:"trace_id,omitempty"`
+}
+
+// errorTraceID includes the request's trace ID in error envelopes. It is
+// configured with ERROR_TRACE_ID.
+var errorTraceID = true
+
+// writeJSON sends v as JSON and counts encode failures. The serializer encodes
+// the whole body before writing, so an error on an uncommitted response means
+// v could not be encoded; the error handler then answers with a 500.
+func writeJSON(c echo.Context, code int, v interface{}) error {
+	err := c.JSON(code, v)
+	if err != nil && !c.Response().Committed {
+		encodeErrors.Inc()
+		log.Printf("failed to encode %s response: %v", c.Path(), err)
+	}
+	return err
+}
+
+// camelCaseFields is set by JSON_FIELD_CASE=camel. Exports encode without
+// Echo's serializer and check it through jsonFields.
+var camelCaseFields = false
+
+// camelCaseSerializer serves the snake_case field names of the struct tags as
+// camelCase and accepts camelCase request bodies, for JSON_FIELD_CASE=camel.
+type camelCaseSerializer struct {
+	echo.DefaultJSONSerializer
+}
+
+func (s camelCaseSerializer) Serialize(c echo.Context, i interface{}, indent string) error {
+	enc := json.NewEncoder(c.Response())
+	if indent != "" {
+		enc.SetIndent("", indent)
+	}
+	return enc.Encode(camelCaseValue(reflect.ValueOf(i)))
+}
+
+// jsonFields returns v ready for a json.Encoder in the configured field case.
+func jsonFields(v interface{}) interface{} {
+	if !camelCaseFields {
+		return v
+	}
+	return camelCaseValue(reflect.ValueOf(v))
+}
+
+// camelCaseValue rebuilds v with its struct field names in camelCase,
+// following the encoding/json field rules. Map keys are data, such as the
+// metric names on /stats, and are left alone. Values with their own JSON
+// encoding, like time.Time, are returned as they are.
+func camelCaseValue(v reflect.Value) interface{} {
+	if !v.IsValid() {
+		return nil
+	}
+	if v.Type().Implements(jsonMarshalerType) || v.Type().Implements(textMarshalerType) {
+		return v.Interface()
+	}
+	if v.CanAddr() && reflect.PointerTo(v.Type()).Implements(jsonMarshalerType) {
+		return v.Addr().Interface()
+	}
+	switch v.Kind() {
+	case reflect.Pointer, reflect.Interface:
+		if v.IsNil() {
+			return nil
+		}
+		return camelCaseValue(v.Elem())
+	case reflect.Struct:
+		obj := &camelCaseObject{}
+		appendCamelCaseFields(obj, v)
+		return obj
+	case reflect.Map:
+		if v.IsNil() {
+			return nil
+		}
+		out := make(map[string]interface{}, v.Len())
+		for iter := v.MapRange(); iter.Next(); {
+			out[fmt.Sprint(iter.Key().Interface())] = camelCaseValue(iter.Value())
+		}
+		return out
+	case reflect.Slice:
+		if v.IsNil() {
+			return nil
+		}
+		if v.Type().Elem().Kind() == reflect.Uint8 {
+			return v.Interface() // base64, like encoding/json
+		}
+		fallthrough
+	case reflect.Array:
+		out := make([]interface{}, v.Len())
+		for i := range out {
+			out[i] = camelCaseValue(v.Index(i))
+		}
+		return out
+	}
+	return v.Interface()
+}
+
+var (
+	jsonMarshalerType = reflect.TypeFor[json.Marshaler]()
+	textMarshalerType = reflect.TypeFor[encoding.TextMarshaler]()
+)
+
+// appendCamelCaseFields adds the encoded fields of struct v to obj, promoting
+// the fields of untagged embedded structs as encoding/json does.
+func appendCamelCaseFields(obj *camelCaseObject, v reflect.Value) {
+	for i := 0; i < v.NumField(); i++ {
+		field := v.Type().Field(i)
+		tag := field.Tag.Get("json")
+		if tag == "-" || (!field.IsExported() && !field.Anonymous) {
+			continue
+		}
+		name, opts, _ := strings.Cut(tag, ",")
+		value := v.Field(i)
+		if field.Anonymous && name == "" {
+			if value.Kind() == reflect.Pointer {
+				if value.IsNil() {
+					continue
+				}
+				value = value.Elem()
+			}
+			if value.Kind() == reflect.Struct {
+				appendCamelCaseFields(obj, value)
+				continue
+			}
+		}
+		if !field.IsExported() {
+			continue
+		}
+		if name == "" {
+			name = field.Name
+		}
+		if strings.Contains(opts, "omitempty") && isEmptyJSONValue(value) {
+			continue
+		}
+		obj.keys = append(obj.keys, snakeToCamel(name))
+		obj.values = append(obj.values, camelCaseValue(value))
+	}
+}
+
+// isEmptyJSONValue reports whether omitempty drops v.
+func isEmptyJSONValue(v reflect.Value) bool {
+	switch v.Kind() {
+	case reflect.Array, reflect.Map, reflect.Slice, reflect.String:
+		return v.Len() == 0
+	case reflect.Pointer, reflect.Interface:
+		return v.IsNil()
+	case reflect.Struct:
+		return false
+	}
+	return v.IsZero()
+}
+
+// camelCaseObject is a JSON object that keeps the struct's field order.
+type camelCaseObject struct {
+	keys   []string
+	values []interface{}
+}
+
+func (o *camelCaseObject) MarshalJSON() ([]byte, error) {
+	var buf bytes.Buffer
+	buf.WriteByte('{')
+	for i, key := range o.keys {
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+		k, err := json.Marshal(key)
+		if err != nil {
+			return nil, err
+		}
+		value, err := json.Marshal(o.values[i])
+		if err != nil {
+			return nil, err
+		}
+		buf.Write(k)
+		buf.WriteByte(':')
+		buf.Write(value)
+	}
+	buf.WriteByte('}')
+	return buf.Bytes(), nil
+}
+
+func (s camelCaseSerializer) Deserialize(c echo.Context, i interface{}) error {
+	body, err := io.ReadAll(c.Request().Body)
+	if err != nil {
+		return err
+	}
+	var v interface{}
+	dec := json.NewDecoder(bytes.NewReader(body))
+	dec.UseNumber()
+	// Malformed bodies go to the default decoder as-is for its error.
+	if dec.Decode(&v) == nil {
+		if body, err = json.Marshal(renameKeys(v, camelToSnake)); err != nil {
+			return err
+		}
+	}
+	c.Request().Body = io.NopCloser(bytes.NewReader(body))
+	return s.DefaultJSONSerializer.Deserialize(c, i)
+}
+
+// renameKeys applies rename to every object key in a decoded JSON value.
+func renameKeys(v interface{}, rename func(string) string) interface{} {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		out := make(map[string]interface{}, len(v))
+		for key, value := range v {
+			out[rename(key)] = renameKeys(value, rename)
+		}
+		return out
+	case []interface{}:
+		for i, value := range v {
+			v[i] = renameKeys(value, rename)
+		}
+	}
+	return v
+}
+
+func snakeToCamel(key string) string {
+	parts := strings.Split(key, "_")
+	for i := 1; i < len(parts); i++ {
+		if parts[i] != "" {
+			parts[i] = strings.ToUpper(parts[i][:1]) + parts[i][1:]
+		}
+	}
+	return strings.Join(parts, "")
+}
+
+// camelToSnake starts a word at each uppercase letter, treating a run of
+// uppercase letters as one word: traceID becomes trace_id and HTTPStatus
+// becomes http_status.
+func camelToSnake(key string) string {
+	runes := []rune(key)
+	var b strings.Builder
+	for i, r := range runes {
+		if unicode.IsUpper(r) {
+			// A run ends before its last letter when a lowercase one follows,
+			// as in the S of HTTPStatus.
+			if i > 0 && (!unicode.IsUpper(runes[i-1]) || i+1 < len(runes) && unicode.IsLower(runes[i+1])) {
+				b.WriteByte('_')
+			}
+			r = unicode.ToLower(r)
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
+
+// httpErrorHandler renders every error, including Echo's own 404 and 405
+// responses, as an errorResponse. Codes are derived from the status text,
+// e.g. 404 becomes "not_found".
+func httpErrorHandler(err error, c echo.Context) {
+	if c.Response().Committed {
+		return
+	}
+
+	status := http.StatusInternalServerError
+	message := http.StatusText(status)
+	var fields map[string]string
+	var he *echo.HTTPError
+	var ve *validationError
+	switch {
+	case errors.As(err, &ve):
+		status = http.StatusUnprocessableEntity
+		message = "validation failed"
+		fields = ve.fields
+	case errors.As(err, &he):
+		status = he.Code
+		message = http.StatusText(status)
+		if m, ok := he.Message.(string); ok {
+			message = m
+		}
+	}
+	code := strings.ToLower(strings.ReplaceAll(http.StatusText(status), " ", "_"))
+
+	if c.Request().Method == http.MethodHead {
+		err = c.NoContent(status)
+	} else {
+		resp := errorResponse{Code: code, Message: message, Fields: fields}
+		// Errors raised before tracingMiddleware runs have no span.
+		if sc := trace.SpanContextFromContext(c.Request().Context()); errorTraceID && sc.HasTraceID() {
+			resp.TraceID = sc.TraceID().String()
+		}
+		err = c.JSON(status, resp)
+	}
+	if err != nil {
+		c.Logger().Error(err)
+	}
+}
+
+// requestLogFormat is Echo's default JSON log line plus the request id and the
+// trace id (the ${custom} tag) so log lines can be matched to traces.
+const requestLogFormat = `{"time":"${time_rfc3339_nano}","id":"${id}","request_id":"${header:X-Request-ID}",` +
+	`"trace_id":"${custom}","remote_ip":"${remote_ip}","host":"${host}","method":"${method}","uri":"${uri}",` +
+	`"user_agent":"${user_agent}","status":${status},"error":"${error}","latency":${latency},` +
+	`"latency_human":"${latency_human}","bytes_in":${bytes_in},"bytes_out":${bytes_out}}` + "\n"
+
+// sampleRequestLogs drops all but rate of the request log lines for requests
+// that succeed. The request logger writes through c.Logger().Output(), so a
+// per-request logger decides once the status is known. The decision follows
+// the trace ID the way TraceIDRatioBased does, so at equal rates the logged
+// requests are the traced ones.
+func sampleRequestLogs(rate float64) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		if rate >= 1 {
+			return next
+		}
+		return func(c echo.Context) error {
+			c.SetLogger(&sampledLogger{Logger: c.Logger(), c: c, rate: rate})
+			return next(c)
+		}
+	}
+}
+
+type sampledLogger struct {
+	echo.Logger
+	c    echo.Context
+	rate float64
+}
+
+func (l *sampledLogger) Output() io.Writer {
+	return l
+}
+
+func (l *sampledLogger) Write(p []byte) (int, error) {
+	if l.c.Response().Status < http.StatusBadRequest {
+		traceID := trace.SpanContextFromContext(l.c.Request().Context()).TraceID()
+		if binary.BigEndian.Uint64(traceID[8:16])>>1 >= uint64(l.rate*(1<<63)) {
+			return len(p), nil
+		}
+	}
+	return l.Logger.Output().Write(p)
+}
+
+// logTraceID writes the trace id of the request's span, if it has one. It
+// relies on tracingMiddleware running inside the logger.
+func logTraceID(c echo.Context, buf *bytes.Buffer) (int, error) {
+	sc := trace.SpanContextFromContext(c.Request().Context())
+	if !sc.HasTraceID() {
+		return 0, nil
+	}
+	return buf.WriteString(sc.TraceID().String())
+}
+
+// sensitiveHeaders are never recorded on spans, even when allowlisted.
+var sensitiveHeaders = map[string]bool{
+	"Authorization":       true,
+	"Proxy-Authorization": true,
+	"Cookie":              true,
+	"Set-Cookie":          true,
+	"X-Api-Key":           true,
+}
+
+func parseTraceHeaders(v string) []string {
+	var headers []string
+	for _, h := range strings.Split(v, ",") {
+		h = http.CanonicalHeaderKey(strings.TrimSpace(h))
+		if h == "" || sensitiveHeaders[h] {
+			continue
+		}
+		headers = append(headers, h)
+	}
+	return headers
+}
+
+func headerAttributes(prefix string, header http.Header, names []string) []attribute.KeyValue {
+	var attrs []attribute.KeyValue
+	for _, name := range names {
+		if values := header.Values(name); len(values) > 0 {
+			attrs = append(attrs, attribute.StringSlice(prefix+strings.ToLower(name), values))
+		}
+	}
+	return attrs
+}
+
+type recentTrace struct {
+	TraceID string    `json:"trace_id"`
+	Sampled bool      `json:"sampled"`
+	Method  string    `json:"method"`
+	Route   string    `json:"route"`
+	Status  int       `json:"status"`
+	Time    time.Time `json:"time"`
+}
+
+// traceRing keeps the last handled requests in a fixed-size ring buffer.
+type traceRing struct {
+	mu      sync.Mutex
+	entries []recentTrace
+	next    int
+	full    bool
+}
+
+func newTraceRing(size int) *traceRing {
+	return &traceRing{entries: make([]recentTrace, size)}
+}
+
+func (r *traceRing) add(t recentTrace) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if len(r.entries) == 0 {
+		return
+	}
+	r.entries[r.next] = t
+	r.next = (r.next + 1) % len(r.entries)
+	if r.next == 0 {
+		r.full = true
+	}
+}
+
+// list returns the buffered requests, newest first.
+func (r *traceRing) list() []recentTrace {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	n := r.next
+	if r.full {
+		n = len(r.entries)
+	}
+	out := make([]recentTrace, 0, n)
+	for i := 1; i <= n; i++ {
+		out = append(out, r.entries[(r.next-i+len(r.entries))%len(r.entries)])
+	}
+	return out
+}
+
+// explainSorts maps sort values to ORDER BY clauses for /debug/explain.
+var explainSorts = map[string]string{
+	"":      "pinned DESC, id",
+	"id":    "id",
+	"title": "title",
+}
+
+type queryPlanRow struct {
+	ID     int    `json:"id"`
+	Parent int    `json:"parent"`
+	Detail string `json:"detail"`
+}
+
+// explainTodos returns the SQLite query plan for the todo list query, with
+// the optional completed filter and sort applied, to check index usage.
+func explainTodos(c echo.Context) error {
+	orderBy, ok := explainSorts[c.QueryParam("sort")]
+	if !ok {
+		return echo.NewHTTPError(http.StatusBadRequest, "sort must be id or title")
+	}
+	query := "SELECT " + todoColumns + " FROM todos"
+	var args []interface{}
+	if v := c.QueryParam("completed"); v != "" {
+		completed, err := strconv.ParseBool(v)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusBadRequest, "completed must be true or false")
+		}
+		query += " WHERE completed = ?"
+		args = append(args, completed)
+	}
+	query += " ORDER BY " + orderBy
+
+	rows, err := db.QueryContext(c.Request().Context(), "EXPLAIN QUERY PLAN "+query, args...)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to explain query")
+	}
+	defer rows.Close()
+
+	plan := []queryPlanRow{}
+	for rows.Next() {
+		var row queryPlanRow
+		var unused int
+		if err := rows.Scan(&row.ID, &row.Parent, &unused, &row.Detail); err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to scan row")
+		}
+		plan = append(plan, row)
+	}
+	if err := rows.Err(); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to read query plan")
+	}
+
+	return writeJSON(c, http.StatusOK, map[string]interface{}{"query": query, "plan": plan})
+}
+
+func getRecentTraces(c echo.Context) error {
+	return writeJSON(c, http.StatusOK, recentTraces.list())
+}
+
+func tracingMiddleware(headers []string) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			req := c.Request()
+			attrs := []attribute.KeyValue{semconv.HTTPMethod(req.Method), urlPathKey.String(req.URL.Path)}
+			// The route template, not the concrete path, keeps span grouping
+			// low-cardinality.
+			if route := c.Path(); route != "" {
+				attrs = append(attrs, semconv.HTTPRoute(route))
+			}
+			ctx, span := tracer.Start(req.Context(), req.Method+" "+c.Path(),
+				trace.WithSpanKind(trace.SpanKindServer),
+				trace.WithAttributes(attrs...),
+				trace.WithAttributes(headerAttributes("http.request.header.", req.Header, headers)...),
+			)
+			defer span.End()
+			c.SetRequest(req.WithContext(ctx))
+
+			err := next(c)
+			if err != nil {
+				c.Error(err)
+			}
+
+			span.SetAttributes(semconv.HTTPStatusCode(c.Response().Status))
+			span.SetAttributes(headerAttributes("http.response.header.", c.Response().Header(), headers)...)
+			recentTraces.add(recentTrace{
+				TraceID: span.SpanContext().TraceID().String(),
+				Sampled: span.SpanContext().IsSampled(),
+				Method:  req.Method,
+				Route:   c.Path(),
+				Status:  c.Response().Status,
+				Time:    time.Now(),
+			})
+			return err
+		}
+	}
+}
+
+// limitURLLength rejects requests whose path and query exceed max bytes.
+func limitURLLength(max int) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			if max > 0 && len(c.Request().RequestURI) > max {
+				return echo.NewHTTPError(http.StatusRequestURITooLong, "request URI too long")
+			}
+			return next(c)
+		}
+	}
+}
+
+// limitHeaderFields rejects requests carrying more than max header fields.
+// The server's MaxHeaderBytes already bounds their total size.
+func limitHeaderFields(max int) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			fields := 0
+			for _, values := range c.Request().Header {
+				fields += len(values)
+			}
+			if max > 0 && fields > max {
+				return echo.NewHTTPError(http.StatusRequestHeaderFieldsTooLarge, "too many header fields")
+			}
+			return next(c)
+		}
+	}
+}
+
+// featureRoutes are experimental endpoints that are only served when their
+// feature is listed in FEATURES.
+var featureRoutes = []struct {
+	feature string
+	method  string
+	path    string
+	handler echo.HandlerFunc
+}{
+	{"board", http.MethodGet, "/todos/board", getTodoBoard},
+}
+
+var enabledFeatures map[string]bool
+
+// allowFeatureHeader lets X-Enable-Feature turn on gated features for a single
+// request. It is meant for QA and must stay off in production.
+var allowFeatureHeader bool
+
+func parseSet(v string) map[string]bool {
+	set := make(map[string]bool)
+	for _, item := range strings.Split(v, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			set[item] = true
+		}
+	}
+	return set
+}
+
+func requireFeature(feature string) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			if !enabledFeatures[feature] &&
+				!(allowFeatureHeader && parseSet(c.Request().Header.Get("X-Enable-Feature"))[feature]) {
+				return echo.ErrNotFound
+			}
+			return next(c)
+		}
+	}
+}
+
+// requireAdmin guards admin routes with a bearer token. Admin routes are
+// disabled entirely when no token is configured.
+func requireAdmin(token string) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			if token == "" {
+				return echo.ErrNotFound
+			}
+			auth := c.Request().Header.Get(echo.HeaderAuthorization)
+			if subtle.ConstantTimeCompare([]byte(auth), []byte("Bearer "+token)) != 1 {
+				return echo.ErrUnauthorized
+			}
+			return next(c)
+		}
+	}
+}
+
+// cachePolicies maps GET routes to their Cache-Control header. Entries from
+// CACHE_CONTROL, formatted as "/route=policy;/route=policy", override these.
+var cachePolicies = map[string]string{
+	"/todos":         "no-cache",
+	"/todos/deleted": "no-cache",
+	"/todos/export":  "no-store",
+	"/stats":         "no-store",
+	"/time":          "no-store",
+}
+
+func parseCachePolicies(v string) map[string]string {
+	policies := make(map[string]string, len(cachePolicies))
+	for route, policy := range cachePolicies {
+		policies[route] = policy
+	}
+	for _, entry := range strings.Split(v, ";") {
+		route, policy, ok := strings.Cut(entry, "=")
+		if route = strings.TrimSpace(route); !ok || route == "" {
+			continue
+		}
+		policies[route] = strings.TrimSpace(policy)
+	}
+	return policies
+}
+
+// cacheControl sets the configured Cache-Control header on successful GET and
+// HEAD responses. Errors are left uncached.
+func cacheControl(policies map[string]string) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			method := c.Request().Method
+			policy := policies[c.Path()]
+			if policy == "" || (method != http.MethodGet && method != http.MethodHead) {
+				return next(c)
+			}
+			res := c.Response()
+			res.Before(func() {
+				if res.Status < http.StatusBadRequest && res.Header().Get(echo.HeaderCacheControl) == "" {
+					res.Header().Set(echo.HeaderCacheControl, policy)
+				}
+			})
+			return next(c)
+		}
+	}
+}
+
+// corsOrigins is the allowed origin set, swapped whole when it is reloaded.
+var corsOrigins atomic.Pointer[map[string]bool]
+
+// loadCORSOrigins merges the origins listed in CORS_ORIGINS with those in
+// CORS_ORIGINS_FILE, one per line. Blank lines and # comments are ignored.
+func loadCORSOrigins(list, file string) (map[string]bool, error) {
+	origins := parseSet(list)
+	if file == "" {
+		return origins, nil
+	}
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		if line = strings.TrimSpace(line); line != "" && !strings.HasPrefix(line, "#") {
+			origins[line] = true
+		}
+	}
+	return origins, nil
+}
+
+// reloadCORSOrigins reloads the origin file on SIGHUP. A file that fails to
+// load keeps the previous origins in place.
+func reloadCORSOrigins(list, file string) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	for range hup {
+		origins, err := loadCORSOrigins(list, file)
+		if err != nil {
+			log.Printf("failed to reload CORS origins: %v", err)
+			continue
+		}
+		corsOrigins.Store(&origins)
+		log.Printf("reloaded %d CORS origins", len(origins))
+	}
+}
+
+func allowCORSOrigin(origin string) (bool, error) {
+	origins := *corsOrigins.Load()
+	return origins["*"] || origins[origin], nil
+}
+
+// timeRequests observes request latency for every route not in noHistogram.
+// Excluded routes only skip the histogram buckets, which dominate series
+// count on busy routes; the API routes still count into http_request_count.
+// The default exclusions, /metrics and /metrics/app, are never in that
+// counter and are counted by promhttp_metric_handler_requests_total instead.
+func timeRequests(noHistogram map[string]bool) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			endpoint := c.Path()
+			if endpoint == "" {
+				endpoint = "unmatched"
+			}
+			if noHistogram[endpoint] {
+				return next(c)
+			}
+			start := time.Now()
+			defer func() {
+				requestDuration.WithLabelValues(c.Request().Method, endpoint).Observe(time.Since(start).Seconds())
+			}()
+			return next(c)
+		}
+	}
+}
+
+func trackInFlight(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		// The route template keeps the label bounded; unmatched requests all
+		// share one series.
+		endpoint := c.Path()
+		if endpoint == "" {
+			endpoint = "unmatched"
+		}
+		gauge := routeInFlight.WithLabelValues(endpoint)
+
+		inFlight.Inc()
+		gauge.Inc()
+		defer func() {
+			gauge.Dec()
+			inFlight.Dec()
+		}()
+		return next(c)
+	}
+}
+
+// dbDegraded is set by the readiness check while database pings are slow.
+// Writes are rejected meanwhile so they do not pile onto a struggling DB.
+var dbDegraded atomic.Bool
+
+// healthHandler reports liveness only: the process is up and serving. It
+// never touches the database, so a slow database does not get it restarted.
+func healthHandler(c echo.Context) error {
+	return writeJSON(c, http.StatusOK, struct {
+		Status string `json:"status"`
+	}{"ok"})
+}
+
+// readyHandler pings the database. A failed ping makes the instance not
+// ready; a ping slower than threshold keeps it ready for reads but marks the
+// database degraded.
+func readyHandler(threshold time.Duration) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		ctx, cancel := context.WithTimeout(c.Request().Context(), 2*time.Second)
+		defer cancel()
+
+		start := time.Now()
+		err := db.PingContext(ctx)
+		latency := time.Since(start)
+		if err != nil {
+			dbDegraded.Store(true)
+			return echo.NewHTTPError(http.StatusServiceUnavailable, "database unavailable")
+		}
+
+		degraded := threshold > 0 && latency > threshold
+		if degraded != dbDegraded.Swap(degraded) {
+			log.Printf("database degraded: %t (ping took %s)", degraded, latency)
+		}
+		status := "ok"
+		if degraded {
+			status = "degraded"
+		}
+		return writeJSON(c, http.StatusOK, struct {
+			Status string `json:"status"`
+			DBPing string `json:"db_ping"`
+		}{status, latency.String()})
+	}
+}
+
+// readOnly is set by READ_ONLY or POST /admin/read-only for maintenance.
+var readOnly atomic.Bool
+
+// guardWrites fails writes fast in read-only mode and while dbDegraded is
+// set. Admin routes stay available so operators can act on the database.
+func guardWrites(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		switch c.Request().Method {
+		case http.MethodGet, http.MethodHead, http.MethodOptions:
+			return next(c)
+		}
+		if strings.HasPrefix(c.Path(), "/admin/") {
+			return next(c)
+		}
+		if readOnly.Load() {
+			return echo.NewHTTPError(http.StatusServiceUnavailable, "service is in read-only mode for maintenance")
+		}
+		if dbDegraded.Load() {
+			return echo.NewHTTPError(http.StatusServiceUnavailable, "database degraded, writes are temporarily rejected")
+		}
+		return next(c)
+	}
+}
+
+func setReadOnly(c echo.Context) error {
+	enabled, err := strconv.ParseBool(c.QueryParam("enabled"))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "enabled must be true or false")
+	}
+	if readOnly.Swap(enabled) != enabled {
+		log.Printf("read-only mode: %t", enabled)
+	}
+	return writeJSON(c, http.StatusOK, struct {
+		ReadOnly bool `json:"read_only"`
+	}{enabled})
+}
+
+func timeHandler(c echo.Context) error {
+	now := time.Now().In(location)
+	return writeJSON(c, http.StatusOK, map[string]string{
+		"time":     now.Format(time.RFC3339),
+		"timezone": location.String(),
+	})
+}
+
+func dumpMetrics(c echo.Context) error {
+	path := c.QueryParam("path")
+	if path == "" {
+		return echo.NewHTTPError(http.StatusBadRequest, "path is required")
+	}
+
+	families, err := gatherMetrics(prometheus.Gatherers{prometheus.DefaultGatherer, appRegistry})
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to gather metrics")
+	}
+
+	f, err := os.Create(path)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to create dump file")
+	}
+	defer f.Close()
+
+	written := 0
+	for _, mf := range families {
+		n, err := expfmt.MetricFamilyToText(f, mf)
+		written += n
+		if err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to write metrics")
+		}
+	}
+	if err := f.Close(); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to write metrics")
+	}
+
+	return writeJSON(c, http.StatusOK, map[string]interface{}{"path": path, "bytes": written})
+}
+
+var (
+	gaugeMu sync.Mutex
+
+	// oldestPendingEmptyNaN reports an empty backlog as NaN rather than 0.
+	oldestPendingEmptyNaN bool
+)
+
+// refreshGauges recomputes the gauges derived from the database.
+func refreshGauges(ctx context.Context) error {
+	gaugeMu.Lock()
+	defer gaugeMu.Unlock()
+
+	var pending, completed float64
+	err := db.QueryRowContext(ctx, `SELECT
+		COUNT(*) FILTER (WHERE NOT completed),
+		COUNT(*) FILTER (WHERE completed)
+		FROM todos`).Scan(&pending, &completed)
+	if err != nil {
+		return err
+	}
+	todoItems.WithLabelValues("pending").Set(pending)
+	todoItems.WithLabelValues("completed").Set(completed)
+
+	var age sql.NullFloat64
+	err = db.QueryRowContext(ctx, `SELECT CAST(strftime('%s', 'now') - strftime('%s', MIN(created_at)) AS REAL)
+		FROM todos WHERE NOT completed AND created_at IS NOT NULL`).Scan(&age)
+	if err != nil {
+		return err
+	}
+	switch {
+	case age.Valid:
+		oldestPending.Set(age.Float64)
+	case oldestPendingEmptyNaN:
+		oldestPending.Set(math.NaN())
+	default:
+		oldestPending.Set(0)
+	}
+
+	if !isInMemoryDB(dbPath) {
+		info, err := os.Stat(dbPath)
+		if err != nil {
+			return err
+		}
+		dbFileSize.Set(float64(info.Size()))
+	}
+	return nil
+}
+
+func collectGauges(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		dbSwap.RLock()
+		err := refreshGauges(context.Background())
+		dbSwap.RUnlock()
+		if err != nil {
+			log.Printf("failed to refresh gauges: %v", err)
+		}
+		<-ticker.C
+	}
+}
+
+// dbSwap is held for reading by every request that may use db and for
+// writing while /admin/rotate replaces it.
+var dbSwap sync.RWMutex
+
+func holdDB(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		if c.Path() == "/admin/rotate" {
+			return next(c)
+		}
+		dbSwap.RLock()
+		defer dbSwap.RUnlock()
+		return next(c)
+	}
+}
+
+// rotateDB moves the database file to archive_path and starts over with a
+// freshly migrated database. In-flight requests finish first and new ones
+// wait for the swap.
+func rotateDB(c echo.Context) error {
+	archive := c.QueryParam("archive_path")
+	if archive == "" {
+		return echo.NewHTTPError(http.StatusBadRequest, "archive_path is required")
+	}
+	if isInMemoryDB(dbPath) {
+		return echo.NewHTTPError(http.StatusBadRequest, "an in-memory database cannot be rotated")
+	}
+
+	// Long polls hold dbSwap while they wait, and new readers queue behind
+	// the pending Lock, so every poll has to let go before the swap.
+	longPolls.release()
+	dbSwap.Lock()
+	defer dbSwap.Unlock()
+	defer longPolls.reset()
+
+	// Checked under the lock so concurrent rotations cannot both pass;
+	// os.Rename would silently replace an existing archive.
+	if _, err := os.Stat(archive); err == nil {
+		return echo.NewHTTPError(http.StatusConflict, "archive_path already exists")
+	}
+	// No request holds the old handle, so moving the file under it is safe
+	// and it can keep serving if the new database fails to open.
+	if err := os.Rename(dbPath, archive); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to move database to archive_path")
+	}
+	old := db
+	if err := initDB(); err != nil {
+		log.Printf("failed to open a fresh database after rotating: %v", err)
+		if db != old {
+			db.Close()
+		}
+		db = old
+		if err := os.Rename(archive, dbPath); err != nil {
+			log.Printf("failed to move %s back to %s: %v", archive, dbPath, err)
+		}
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to open a fresh database")
+	}
+
+	if stmts != nil {
+		stmts.close()
+		stmts = newStmtCache()
+	}
+	if err := old.Close(); err != nil {
+		log.Printf("failed to close the archived database: %v", err)
+	}
+	if createDedupe != nil {
+		createDedupe = newCreateDeduper(createDedupe.window)
+	}
+
+	todoChanges.notify()
+	log.Printf("rotated database to %s", archive)
+	return writeJSON(c, http.StatusOK, struct {
+		ArchivePath string `json:"archive_path"`
+	}{archive})
+}
+
+func refreshGaugesHandler(c echo.Context) error {
+	if err := refreshGauges(c.Request().Context()); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to refresh gauges")
+	}
+	return c.NoContent(http.StatusNoContent)
+}
+
+var tlsVersions = map[string]uint16{
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// tlsConfig builds the server TLS settings. Cipher suites are given by their
+// Go names and only apply to TLS 1.2; TLS 1.3 suites are not configurable.
+func tlsConfig(certFile, keyFile, minVersion, cipherSuites string) (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+	version, ok := tlsVersions[minVersion]
+	if !ok {
+		return nil, fmt.Errorf("TLS_MIN_VERSION %q: want 1.2 or 1.3", minVersion)
+	}
+	cfg := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   version,
+	}
+
+	if cipherSuites == "" {
+		return cfg, nil
+	}
+	known := make(map[string]uint16)
+	for _, suite := range tls.CipherSuites() {
+		known[suite.Name] = suite.ID
+	}
+	for name := range parseSet(cipherSuites) {
+		id, ok := known[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown or insecure cipher suite %q", name)
+		}
+		cfg.CipherSuites = append(cfg.CipherSuites, id)
+	}
+	return cfg, nil
+}
+
+func main() {
+	if err := run(); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// listen binds the service port; tests replace it to observe binding.
+var listen = net.Listen
+
+// run starts the service in stages that each return their error. Storage and
+// telemetry are ready before the listener is bound, so no request is served
+// by a half-initialized process and a failed stage never binds the port.
+func run() error {
+	demoMode, err := envBool("DEMO_MODE", true)
+	if err != nil {
+		return err
+	}
+	// The producer only exists in binaries built with the demo tag.
+	demoMode = demoMode && demoBuild
+
+	if tz := os.Getenv("TIMEZONE"); tz != "" {
+		loc, err := time.LoadLocation(tz)
+		if err != nil {
+			return fmt.Errorf("invalid TIMEZONE: %w", err)
+		}
+		location = loc
+	}
+
+	dbPath = envString("DB_PATH", dbPath)
+	enabledFeatures = parseSet(os.Getenv("FEATURES"))
+	if maxDescriptionLength, err = envInt("MAX_DESCRIPTION_LENGTH", 1000); err != nil {
+		return err
+	}
+	if dbSpanSampleRatio, err = envFloat("DB_SPAN_SAMPLE_RATIO", 1.0); err != nil {
+		return err
+	}
+	if traceMemStats, err = envBool("TRACE_MEM_STATS", false); err != nil {
+		return err
+	}
+	if slowQueryThreshold, err = envDuration("SLOW_QUERY_THRESHOLD", 0); err != nil {
+		return err
+	}
+	if normalizeTitles, err = envBool("TITLE_NORMALIZE", false); err != nil {
+		return err
+	}
+	if lowercaseTitles, err = envBool("TITLE_LOWERCASE", false); err != nil {
+		return err
+	}
+	if uniqueTitles, err = envBool("UNIQUE_TITLES", false); err != nil {
+		return err
+	}
+	if oldestPendingEmptyNaN, err = envBool("OLDEST_PENDING_EMPTY_NAN", false); err != nil {
+		return err
+	}
+	if errorTraceID, err = envBool("ERROR_TRACE_ID", true); err != nil {
+		return err
+	}
+	if allowFeatureHeader, err = envBool("ALLOW_FEATURE_HEADER", false); err != nil {
+		return err
+	}
+	startReadOnly, err := envBool("READ_ONLY", false)
+	if err != nil {
+		return err
+	}
+	readOnly.Store(startReadOnly)
+	size, err := envInt("RECENT_TRACES_SIZE", 100)
+	if err != nil {
+		return err
+	}
+	if size < 0 {
+		return fmt.Errorf("invalid RECENT_TRACES_SIZE: must not be negative")
+	}
+	recentTraces = newTraceRing(size)
+	stmtCache, err := envBool("DB_STMT_CACHE", false)
+	if err != nil {
+		return err
+	}
+	dedupeWindow, err := envDuration("CREATE_DEDUPE_WINDOW", 0)
+	if err != nil {
+		return err
+	}
+	listCacheSize, err := envInt("LIST_CACHE_SIZE", 0)
+	if err != nil {
+		return err
+	}
+	listCacheTTL, err := envDuration("LIST_CACHE_TTL", 5*time.Second)
+	if err != nil {
+		return err
+	}
+	gaugeInterval, err := envDuration("GAUGE_REFRESH_INTERVAL", 15*time.Second)
+	if err != nil {
+		return err
+	}
+
+	// Telemetry comes first so storage setup is already observable.
+	if err := initMetrics(demoMode); err != nil {
+		return fmt.Errorf("metrics: %w", err)
+	}
+	tp, err := initTracer()
+	if err != nil {
+		return fmt.Errorf("tracing: %w", err)
+	}
+	defer func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if err := tp.Shutdown(ctx); err != nil {
+			log.Printf("failed to flush traces: %v", err)
+		}
+	}()
+	tracer = tp.Tracer("todo-service")
+
+	if err := initDB(); err != nil {
+		return fmt.Errorf("database: %w", err)
+	}
+	defer func() {
+		if stmts != nil {
+			stmts.close()
+		}
+		if err := db.Close(); err != nil {
+			log.Printf("failed to close database: %v", err)
+		}
+	}()
+	if stmtCache {
+		stmts = newStmtCache()
+	}
+	if dedupeWindow > 0 {
+		createDedupe = newCreateDeduper(dedupeWindow)
+	}
+	if listCacheSize > 0 {
+		listCache = newResponseCache(listCacheSize, listCacheTTL)
+	}
+
+	e, err := newServer()
+	if err != nil {
+		return fmt.Errorf("server: %w", err)
+	}
+
+	ln, err := listen("tcp", ":8000")
+	if err != nil {
+		return fmt.Errorf("failed to listen: %w", err)
+	}
+	if e.Server.TLSConfig != nil {
+		e.TLSListener = tls.NewListener(ln, e.Server.TLSConfig)
+	} else {
+		e.Listener = ln
+	}
+
+	go collectGauges(gaugeInterval)
+	if demoMode {
+		go producer()
+	}
+
+	serveErr := make(chan error, 1)
+	go func() {
+		serveErr <- e.StartServer(e.Server)
+	}()
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	select {
+	case err := <-serveErr:
+		if !errors.Is(err, http.ErrServerClosed) {
+			return fmt.Errorf("server stopped: %w", err)
+		}
+	case <-ctx.Done():
+	}
+
+	longPolls.release()
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := e.Shutdown(shutdownCtx); err != nil {
+		log.Printf("failed to shut down server: %v", err)
+	}
+	return nil
+}
+
+// newServer builds the Echo instance with its middleware and routes.
+func newServer() (*echo.Echo, error) {
+	e := echo.New()
+	e.HTTPErrorHandler = httpErrorHandler
+	switch fieldCase := envString("JSON_FIELD_CASE", "snake"); fieldCase {
+	case "snake":
+		camelCaseFields = false
+	case "camel":
+		camelCaseFields = true
+		e.JSONSerializer = camelCaseSerializer{}
+	default:
+		return nil, fmt.Errorf("invalid JSON_FIELD_CASE %q: want snake or camel", fieldCase)
+	}
+	readHeaderTimeout, err := envDuration("HTTP_READ_HEADER_TIMEOUT", 10*time.Second)
+	if err != nil {
+		return nil, err
+	}
+	maxHeaderBytes, err := envInt("HTTP_MAX_HEADER_BYTES", http.DefaultMaxHeaderBytes)
+	if err != nil {
+		return nil, err
+	}
+	maxHeaderFields, err := envInt("HTTP_MAX_HEADER_FIELDS", 100)
+	if err != nil {
+		return nil, err
+	}
+	maxURLLength, err := envInt("HTTP_MAX_URL_LENGTH", 8192)
+	if err != nil {
+		return nil, err
+	}
+	logSampleRate, err := envFloat("LOG_SAMPLE_RATE", 1.0)
+	if err != nil {
+		return nil, err
+	}
+	requestTimeout, err := envDuration("REQUEST_TIMEOUT", 0)
+	if err != nil {
+		return nil, err
+	}
+	degradedThreshold, err := envDuration("READY_DB_DEGRADED_THRESHOLD", 250*time.Millisecond)
+	if err != nil {
+		return nil, err
+	}
+	// Oversized headers are answered with 431 by net/http itself.
+	e.Server.ReadHeaderTimeout = readHeaderTimeout
+	e.Server.MaxHeaderBytes = maxHeaderBytes
+
+	certFile, keyFile := os.Getenv("TLS_CERT_FILE"), os.Getenv("TLS_KEY_FILE")
+	if (certFile == "") != (keyFile == "") {
+		return nil, errors.New("TLS_CERT_FILE and TLS_KEY_FILE must be set together")
+	}
+	if certFile != "" {
+		cfg, err := tlsConfig(certFile, keyFile, envString("TLS_MIN_VERSION", "1.2"), os.Getenv("TLS_CIPHER_SUITES"))
+		if err != nil {
+			return nil, fmt.Errorf("invalid TLS configuration: %w", err)
+		}
+		e.Server.TLSConfig = cfg
+	}
+
+	e.Pre(limitHeaderFields(maxHeaderFields))
+	e.Pre(limitURLLength(maxURLLength))
+	// Routes are registered without trailing slashes, so /todos/ is either
+	// rewritten or redirected to /todos before routing.
+	switch policy := envString("TRAILING_SLASH", "remove"); policy {
+	case "remove":
+		e.Pre(middleware.RemoveTrailingSlash())
+	case "redirect":
+		e.Pre(middleware.RemoveTrailingSlashWithConfig(middleware.TrailingSlashConfig{
+			RedirectCode: http.StatusMovedPermanently,
+		}))
+	case "off":
+	default:
+		return nil, fmt.Errorf("invalid TRAILING_SLASH %q: want remove, redirect or off", policy)
+	}
+	e.Use(sampleRequestLogs(logSampleRate))
+	e.Use(middleware.LoggerWithConfig(middleware.LoggerConfig{
+		Format:        requestLogFormat,
+		CustomTagFunc: logTraceID,
+	}))
+	e.Use(middleware.Recover())
+	if list, file := os.Getenv("CORS_ORIGINS"), os.Getenv("CORS_ORIGINS_FILE"); list != "" || file != "" {
+		origins, err := loadCORSOrigins(list, file)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load CORS origins: %w", err)
+		}
+		corsOrigins.Store(&origins)
+		if file != "" {
+			go reloadCORSOrigins(list, file)
+		}
+		e.Use(middleware.CORSWithConfig(middleware.CORSConfig{AllowOriginFunc: allowCORSOrigin}))
+	}
+	e.Use(trackInFlight)
+	e.Use(timeRequests(parseSet(envString("HISTOGRAM_DISABLED_ROUTES", "/metrics,/metrics/app"))))
+	e.Use(tracingMiddleware(parseTraceHeaders(envString("TRACE_HEADERS", "X-Request-ID,User-Agent"))))
+	// Long polls stop waiting before REQUEST_TIMEOUT, so they still answer 200.
+	e.Use(detectPoolBusy(requestTimeout))
+	e.Use(holdDB)
+	e.Use(guardWrites)
+	e.Use(cacheControl(parseCachePolicies(os.Getenv("CACHE_CONTROL"))))
+
+	// Routes
 	e.GET("/todos", getTodos)
+	e.HEAD("/todos", countTodos)
+	e.GET("/todos/export", exportTodos)
 	e.POST("/todos", createTodo)
+	e.PUT("/todos", upsertTodo)
 	e.DELETE("/todos/:id", deleteTodo)
-	e.GET("/metrics", metricsHandler)
+	e.POST("/todos/:id/pin", pinTodo)
+	e.DELETE("/todos/:id/pin", unpinTodo)
+	e.GET("/todos/deleted", getDeletedTodos)
+	metricsFormat := envString("METRICS_DEFAULT_FORMAT", "classic")
+	if metricsFormat != "classic" && metricsFormat != "openmetrics" {
+		return nil, fmt.Errorf("invalid METRICS_DEFAULT_FORMAT %q: want classic or openmetrics", metricsFormat)
+	}
+	e.GET("/metrics", metricsHandler(prometheus.DefaultGatherer, metricsFormat))
+	e.GET("/metrics/app", metricsHandler(appRegistry, metricsFormat))
+	e.GET("/stats", statsHandler)
+	e.GET("/time", timeHandler)
+	e.GET("/healthz", healthHandler)
+	e.GET("/readyz", readyHandler(degradedThreshold))
 
-	// Start background producer
-	go producer()
+	adminAuth := requireAdmin(os.Getenv("ADMIN_TOKEN"))
+	admin := e.Group("/admin", adminAuth)
+	admin.POST("/metrics-dump", dumpMetrics)
+	admin.POST("/refresh-gauges", refreshGaugesHandler)
+	admin.POST("/gc", purgeTombstones)
+	admin.POST("/rotate", rotateDB)
+	admin.POST("/read-only", setReadOnly)
 
-	// Start server
-	log.Fatal(e.Start(":8000"))
+	debug := e.Group("/debug", adminAuth)
+	debug.GET("/recent-traces", getRecentTraces)
+	debug.GET("/explain", explainTodos)
+
+	for _, r := range featureRoutes {
+		e.Add(r.method, r.path, r.handler, requireFeature(r.feature))
+	}
+	return e, nil
 }
@@ -0,0 +1,3009 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"database/sql"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"log"
+	"maps"
+	"math"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+)
+
+func TestMain(m *testing.M) {
+	if os.Getenv("TODO_TEST_RUN") == "1" {
+		runChild()
+	}
+	if err := initMetrics(false); err != nil {
+		log.Fatal(err)
+	}
+	tracer = sdktrace.NewTracerProvider().Tracer("test")
+	os.Exit(m.Run())
+}
+
+// runChild runs the real startup for TestStartupFailures and exits. Binding
+// is reported on stdout and then refused, so run returns either way.
+func runChild() {
+	listen = func(network, address string) (net.Listener, error) {
+		fmt.Println("listening")
+		return nil, errors.New("bind refused by test")
+	}
+	if err := run(); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	os.Exit(0)
+}
+
+// recordSpans routes the test's spans to a recorder.
+func recordSpans(t *testing.T) *tracetest.SpanRecorder {
+	t.Helper()
+	recorder := tracetest.NewSpanRecorder()
+	setForTest(t, &tracer, trace.Tracer(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder)).Tracer("test")))
+	return recorder
+}
+
+func endedSpan(t *testing.T, recorder *tracetest.SpanRecorder, name string) sdktrace.ReadOnlySpan {
+	t.Helper()
+	for _, span := range recorder.Ended() {
+		if span.Name() == name {
+			return span
+		}
+	}
+	t.Fatalf("no span named %q", name)
+	return nil
+}
+
+func spanAttribute(span sdktrace.ReadOnlySpan, key attribute.Key) (attribute.Value, bool) {
+	for _, attr := range span.Attributes() {
+		if attr.Key == key {
+			return attr.Value, true
+		}
+	}
+	return attribute.Value{}, false
+}
+
+// setupDB points the service at a fresh database file for the test.
+func setupDB(t *testing.T) {
+	t.Helper()
+	dbPath = filepath.Join(t.TempDir(), "todos.db")
+	if err := initDB(); err != nil {
+		t.Fatalf("initDB: %v", err)
+	}
+	t.Cleanup(func() {
+		db.Close()
+	})
+}
+
+func newTestServer(t *testing.T) *echo.Echo {
+	t.Helper()
+	e, err := newServer()
+	if err != nil {
+		t.Fatalf("newServer: %v", err)
+	}
+	return e
+}
+
+// request serves one request through e. header holds name, value pairs.
+func request(e *echo.Echo, method, target, body string, header ...string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, target, strings.NewReader(body))
+	if body != "" {
+		req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+	}
+	for i := 0; i+1 < len(header); i += 2 {
+		req.Header.Set(header[i], header[i+1])
+	}
+	rec := httptest.NewRecorder()
+	e.ServeHTTP(rec, req)
+	return rec
+}
+
+func createTestTodo(t *testing.T, e *echo.Echo, body string) TodoItem {
+	t.Helper()
+	rec := request(e, http.MethodPost, "/todos", body)
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("POST /todos %s: got %d %s", body, rec.Code, rec.Body)
+	}
+	var todo TodoItem
+	decodeBody(t, rec, &todo)
+	return todo
+}
+
+func decodeBody(t *testing.T, rec *httptest.ResponseRecorder, v interface{}) {
+	t.Helper()
+	if err := json.Unmarshal(rec.Body.Bytes(), v); err != nil {
+		t.Fatalf("decoding %q: %v", rec.Body, err)
+	}
+}
+
+func TestStatsReturnsSelectedMetrics(t *testing.T) {
+	setupDB(t)
+	e := newTestServer(t)
+	createTestTodo(t, e, `{"title":"stats"}`)
+	request(e, http.MethodGet, "/todos", "")
+
+	rec := request(e, http.MethodGet, "/stats", "")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("got %d %s", rec.Code, rec.Body)
+	}
+	var stats map[string]float64
+	decodeBody(t, rec, &stats)
+
+	for _, name := range statsMetrics {
+		if _, ok := stats[name]; !ok {
+			t.Errorf("missing %s in %v", name, stats)
+		}
+	}
+	if stats["http_request_count"] < 2 {
+		t.Errorf("http_request_count = %v, want at least 2", stats["http_request_count"])
+	}
+	if stats["http_todo_count"] < 1 {
+		t.Errorf("http_todo_count = %v, want at least 1", stats["http_todo_count"])
+	}
+	// The /stats request itself is in flight while the registry is read.
+	if stats["http_in_flight_requests"] != 1 {
+		t.Errorf("http_in_flight_requests = %v, want 1", stats["http_in_flight_requests"])
+	}
+}
+
+func TestProducerWithoutDemoMetrics(t *testing.T) {
+	// TestMain initializes metrics with demo mode off.
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		producer()
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("producer kept running without demo metrics")
+	}
+}
+
+// setForTest assigns v to *p until the test ends.
+func setForTest[T any](t *testing.T, p *T, v T) {
+	t.Helper()
+	old := *p
+	*p = v
+	t.Cleanup(func() { *p = old })
+}
+
+func TestUpsertByTitle(t *testing.T) {
+	setForTest(t, &uniqueTitles, true)
+	setupDB(t)
+	e := newTestServer(t)
+
+	rec := request(e, http.MethodPut, "/todos?by=title", `{"title":"groceries","description":"milk"}`)
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("create: got %d %s", rec.Code, rec.Body)
+	}
+	var created TodoItem
+	decodeBody(t, rec, &created)
+
+	tests := []struct {
+		name, body string
+		want       int
+		status     string
+	}{
+		{"update", `{"title":"groceries","description":"eggs"}`, http.StatusOK, statusTodo},
+		{"start", `{"title":"groceries","description":"eggs","status":"in_progress"}`, http.StatusOK, statusInProgress},
+		{"keep in progress", `{"title":"groceries","description":"eggs"}`, http.StatusOK, statusInProgress},
+		{"complete", `{"title":"groceries","description":"eggs","completed":true}`, http.StatusOK, statusDone},
+		{"refused transition", `{"title":"groceries","status":"in_progress"}`, http.StatusConflict, statusDone},
+	}
+	for _, tt := range tests {
+		rec := request(e, http.MethodPut, "/todos?by=title", tt.body)
+		if rec.Code != tt.want {
+			t.Fatalf("%s: got %d %s, want %d", tt.name, rec.Code, rec.Body, tt.want)
+		}
+		var stored TodoItem
+		if err := db.QueryRow("SELECT "+todoColumns+" FROM todos WHERE id = ?", created.ID).Scan(
+			&stored.ID, &stored.Title, &stored.Description, &stored.Completed, &stored.Status, &stored.Pinned); err != nil {
+			t.Fatal(err)
+		}
+		if stored.Status != tt.status || stored.Completed != (tt.status == statusDone) || *stored.Description != "eggs" {
+			t.Errorf("%s: stored %+v, want status %s with description eggs", tt.name, stored, tt.status)
+		}
+	}
+
+	var count int
+	if err := db.QueryRow("SELECT COUNT(*) FROM todos").Scan(&count); err != nil {
+		t.Fatal(err)
+	}
+	if count != 1 {
+		t.Errorf("got %d rows, want 1", count)
+	}
+}
+
+func TestConcurrentFirstUpserts(t *testing.T) {
+	setForTest(t, &uniqueTitles, true)
+	setupDB(t)
+	e := newTestServer(t)
+
+	const n = 8
+	codes := make(chan int, n)
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			codes <- request(e, http.MethodPut, "/todos?by=title", `{"title":"race"}`).Code
+		}()
+	}
+	wg.Wait()
+	close(codes)
+	counts := make(map[int]int)
+	for code := range codes {
+		counts[code]++
+	}
+	if counts[http.StatusCreated] != 1 || counts[http.StatusOK] != n-1 {
+		t.Errorf("status counts %v, want one 201 and %d 200s", counts, n-1)
+	}
+	var rows int
+	if err := db.QueryRow("SELECT COUNT(*) FROM todos WHERE title = 'race'").Scan(&rows); err != nil {
+		t.Fatal(err)
+	}
+	if rows != 1 {
+		t.Errorf("got %d rows titled race, want 1", rows)
+	}
+}
+
+func TestUpsertRequiresUniqueTitles(t *testing.T) {
+	setupDB(t)
+	e := newTestServer(t)
+	if rec := request(e, http.MethodPut, "/todos?by=title", `{"title":"a"}`); rec.Code != http.StatusBadRequest {
+		t.Errorf("without UNIQUE_TITLES: got %d, want 400", rec.Code)
+	}
+}
+
+func TestUpsertRequiresByTitle(t *testing.T) {
+	setupDB(t)
+	e := newTestServer(t)
+	if rec := request(e, http.MethodPut, "/todos", `{"title":"a"}`); rec.Code != http.StatusBadRequest {
+		t.Errorf("got %d, want 400", rec.Code)
+	}
+}
+
+func TestDuplicateTitles(t *testing.T) {
+	tests := []struct {
+		unique bool
+		want   int
+	}{
+		{unique: false, want: http.StatusCreated},
+		{unique: true, want: http.StatusConflict},
+	}
+	for _, tt := range tests {
+		t.Run(fmt.Sprintf("unique=%t", tt.unique), func(t *testing.T) {
+			setForTest(t, &uniqueTitles, tt.unique)
+			setupDB(t)
+			e := newTestServer(t)
+			createTestTodo(t, e, `{"title":"twice"}`)
+			if rec := request(e, http.MethodPost, "/todos", `{"title":"twice"}`); rec.Code != tt.want {
+				t.Errorf("second create: got %d, want %d", rec.Code, tt.want)
+			}
+		})
+	}
+}
+
+func TestUniqueTitlesRenamesExistingDuplicates(t *testing.T) {
+	setupDB(t)
+	for _, title := range []string{"dup", "dup", "other", "dup"} {
+		if _, err := db.Exec("INSERT INTO todos (title) VALUES (?)", title); err != nil {
+			t.Fatal(err)
+		}
+	}
+	db.Close()
+
+	setForTest(t, &uniqueTitles, true)
+	if err := initDB(); err != nil {
+		t.Fatalf("initDB with duplicates: %v", err)
+	}
+	var titles []string
+	rows, err := db.Query("SELECT title FROM todos ORDER BY id")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var title string
+		if err := rows.Scan(&title); err != nil {
+			t.Fatal(err)
+		}
+		titles = append(titles, title)
+	}
+	want := []string{"dup", "dup (2)", "other", "dup (4)"}
+	if !slices.Equal(titles, want) {
+		t.Errorf("got titles %q, want %q", titles, want)
+	}
+	if _, err := db.Exec("INSERT INTO todos (title) VALUES ('dup')"); !isUniqueViolation(err) {
+		t.Errorf("insert of a duplicate title: got %v, want a unique violation", err)
+	}
+}
+
+func TestTraceHeaders(t *testing.T) {
+	t.Setenv("TRACE_HEADERS", "X-Request-ID,User-Agent,Authorization,X-Api-Key")
+	recorder := recordSpans(t)
+	setupDB(t)
+	e := newTestServer(t)
+
+	request(e, http.MethodGet, "/todos", "",
+		"X-Request-ID", "req-1", "User-Agent", "test-agent", "Authorization", "Bearer secret", "X-Api-Key", "key")
+
+	span := endedSpan(t, recorder, "GET /todos")
+	for key, want := range map[attribute.Key]string{
+		"http.request.header.x-request-id": "req-1",
+		"http.request.header.user-agent":   "test-agent",
+	} {
+		got, ok := spanAttribute(span, key)
+		if !ok || !slices.Equal(got.AsStringSlice(), []string{want}) {
+			t.Errorf("%s = %v, want [%s]", key, got.AsStringSlice(), want)
+		}
+	}
+	for _, key := range []attribute.Key{"http.request.header.authorization", "http.request.header.x-api-key"} {
+		if _, ok := spanAttribute(span, key); ok {
+			t.Errorf("sensitive header recorded as %s", key)
+		}
+	}
+}
+
+func TestTodoBoard(t *testing.T) {
+	setForTest(t, &enabledFeatures, map[string]bool{"board": true})
+	setupDB(t)
+	e := newTestServer(t)
+
+	rec := request(e, http.MethodGet, "/todos/board", "")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("got %d %s", rec.Code, rec.Body)
+	}
+	if got := strings.TrimSpace(rec.Body.String()); got != `{"completed":[],"pending":[]}` {
+		t.Errorf("empty board = %s, want empty arrays", got)
+	}
+
+	createTestTodo(t, e, `{"title":"a"}`)
+	createTestTodo(t, e, `{"title":"b","completed":true}`)
+	createTestTodo(t, e, `{"title":"c"}`)
+	createTestTodo(t, e, `{"title":"d","completed":true}`)
+
+	for _, target := range []string{"/todos/board?pending_limit=0", "/todos/board?completed_limit=x"} {
+		if rec := request(e, http.MethodGet, target, ""); rec.Code != http.StatusBadRequest {
+			t.Errorf("%s: got %d, want 400", target, rec.Code)
+		}
+	}
+
+	tests := []struct {
+		target             string
+		pending, completed []string
+	}{
+		{"/todos/board", []string{"a", "c"}, []string{"b", "d"}},
+		{"/todos/board?limit=1", []string{"a"}, []string{"b"}},
+		{"/todos/board?pending_limit=1", []string{"a"}, []string{"b", "d"}},
+		{"/todos/board?completed_limit=1", []string{"a", "c"}, []string{"b"}},
+		{"/todos/board?limit=1&completed_limit=2", []string{"a"}, []string{"b", "d"}},
+		{"/todos/board?pending_limit=2&completed_limit=1", []string{"a", "c"}, []string{"b"}},
+	}
+	for _, tt := range tests {
+		rec := request(e, http.MethodGet, tt.target, "")
+		var board map[string][]TodoItem
+		decodeBody(t, rec, &board)
+		if got := todoTitles(board["pending"]); !slices.Equal(got, tt.pending) {
+			t.Errorf("%s pending = %q, want %q", tt.target, got, tt.pending)
+		}
+		if got := todoTitles(board["completed"]); !slices.Equal(got, tt.completed) {
+			t.Errorf("%s completed = %q, want %q", tt.target, got, tt.completed)
+		}
+	}
+}
+
+func todoTitles(todos []TodoItem) []string {
+	titles := []string{}
+	for _, todo := range todos {
+		titles = append(titles, todo.Title)
+	}
+	return titles
+}
+
+func TestConnMaxIdleTime(t *testing.T) {
+	t.Setenv("DB_CONN_MAX_IDLE_TIME", "10ms")
+	setupDB(t)
+	if err := db.Ping(); err != nil {
+		t.Fatal(err)
+	}
+	// database/sql checks idle connections at most once a second.
+	deadline := time.Now().Add(3 * time.Second)
+	for db.Stats().MaxIdleTimeClosed == 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("idle connection was not closed: %+v", db.Stats())
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+func TestFeatureGatedRoutes(t *testing.T) {
+	setupDB(t)
+	e := newTestServer(t)
+	tests := []struct {
+		features map[string]bool
+		want     int
+	}{
+		{features: map[string]bool{}, want: http.StatusNotFound},
+		{features: map[string]bool{"other": true}, want: http.StatusNotFound},
+		{features: map[string]bool{"board": true}, want: http.StatusOK},
+	}
+	for _, tt := range tests {
+		setForTest(t, &enabledFeatures, tt.features)
+		if rec := request(e, http.MethodGet, "/todos/board", ""); rec.Code != tt.want {
+			t.Errorf("FEATURES=%v: got %d, want %d", tt.features, rec.Code, tt.want)
+		}
+	}
+}
+
+func TestServiceInfoMetric(t *testing.T) {
+	setupDB(t)
+	e := newTestServer(t)
+	want := fmt.Sprintf(`todo_service_info{commit=%q,version=%q} 1`, buildCommit(), version)
+
+	if body := request(e, http.MethodGet, "/metrics", "").Body.String(); !strings.Contains(body, want) {
+		t.Errorf("/metrics does not contain %s", want)
+	}
+	if body := request(e, http.MethodGet, "/metrics/app", "").Body.String(); strings.Contains(body, "todo_service_info") {
+		t.Error("/metrics/app also exposes todo_service_info")
+	}
+}
+
+func TestMetricsDump(t *testing.T) {
+	setupDB(t)
+	t.Setenv("ADMIN_TOKEN", "secret")
+	e := newTestServer(t)
+	path := filepath.Join(t.TempDir(), "metrics.txt")
+
+	if rec := request(e, http.MethodPost, "/admin/metrics-dump?path="+path, ""); rec.Code != http.StatusUnauthorized {
+		t.Errorf("without token: got %d, want 401", rec.Code)
+	}
+	rec := request(e, http.MethodPost, "/admin/metrics-dump?path="+path, "", "Authorization", "Bearer secret")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("got %d %s", rec.Code, rec.Body)
+	}
+	var resp struct {
+		Bytes int `json:"bytes"`
+	}
+	decodeBody(t, rec, &resp)
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(data) != resp.Bytes {
+		t.Errorf("reported %d bytes, file has %d", resp.Bytes, len(data))
+	}
+	families, err := new(expfmt.TextParser).TextToMetricFamilies(bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("dump is not valid exposition text: %v", err)
+	}
+	for _, name := range []string{"go_goroutines", "http_in_flight_requests", "todo_service_info"} {
+		if _, ok := families[name]; !ok {
+			t.Errorf("dump is missing %s", name)
+		}
+	}
+}
+
+// tracerFromInit routes the test's spans through the provider built by
+// initTracer, recording them instead of exporting them.
+func tracerFromInit(t *testing.T) (*sdktrace.TracerProvider, *tracetest.SpanRecorder) {
+	t.Helper()
+	t.Setenv("OTEL_EXPORTER_OTLP_ENDPOINT", "127.0.0.1:1")
+	tp, err := initTracer()
+	if err != nil {
+		t.Fatalf("initTracer: %v", err)
+	}
+	recorder := tracetest.NewSpanRecorder()
+	tp.RegisterSpanProcessor(recorder)
+	t.Cleanup(func() {
+		tp.UnregisterSpanProcessor(recorder)
+		ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+		defer cancel()
+		tp.Shutdown(ctx)
+	})
+	setForTest(t, &tracer, trace.Tracer(tp.Tracer("test")))
+	return tp, recorder
+}
+
+func recordedPaths(recorder *tracetest.SpanRecorder) map[string]bool {
+	paths := make(map[string]bool)
+	for _, span := range recorder.Ended() {
+		if v, ok := spanAttribute(span, urlPathKey); ok {
+			paths[v.AsString()] = true
+		}
+	}
+	return paths
+}
+
+func TestSamplerDropsConfiguredPaths(t *testing.T) {
+	t.Setenv("TRACE_SAMPLE_RATIO", "1.0")
+	_, recorder := tracerFromInit(t)
+	setupDB(t)
+	e := newTestServer(t)
+
+	tests := []struct {
+		path    string
+		sampled bool
+	}{
+		{"/healthz", false},
+		{"/readyz", false},
+		{"/metrics", false},
+		{"/todos", true},
+	}
+	for _, tt := range tests {
+		// Every path is served, so a drop is the sampler's doing and not a 404.
+		if rec := request(e, http.MethodGet, tt.path, ""); rec.Code != http.StatusOK {
+			t.Fatalf("%s: got %d, want 200", tt.path, rec.Code)
+		}
+	}
+
+	paths := recordedPaths(recorder)
+	for _, tt := range tests {
+		if paths[tt.path] != tt.sampled {
+			t.Errorf("%s: sampled %t, want %t at ratio 1.0", tt.path, paths[tt.path], tt.sampled)
+		}
+	}
+}
+
+func TestHealthzIgnoresDatabase(t *testing.T) {
+	setupDB(t)
+	e := newTestServer(t)
+	t.Cleanup(func() { dbDegraded.Store(false) })
+	db.Close()
+	if rec := request(e, http.MethodGet, "/healthz", ""); rec.Code != http.StatusOK {
+		t.Errorf("/healthz with a closed database: got %d, want 200", rec.Code)
+	}
+	if rec := request(e, http.MethodGet, "/readyz", ""); rec.Code != http.StatusServiceUnavailable {
+		t.Errorf("/readyz with a closed database: got %d, want 503", rec.Code)
+	}
+}
+
+func TestDeletedTodosByCursor(t *testing.T) {
+	setupDB(t)
+	e := newTestServer(t)
+	a := createTestTodo(t, e, `{"title":"a"}`)
+	b := createTestTodo(t, e, `{"title":"b"}`)
+	c := createTestTodo(t, e, `{"title":"c"}`)
+
+	deleted := func(target string) (ids []int, cursor int64) {
+		t.Helper()
+		rec := request(e, http.MethodGet, target, "")
+		if rec.Code != http.StatusOK {
+			t.Fatalf("GET %s: got %d %s", target, rec.Code, rec.Body)
+		}
+		var resp struct {
+			IDs    []int `json:"ids"`
+			Cursor int64 `json:"cursor"`
+		}
+		decodeBody(t, rec, &resp)
+		return resp.IDs, resp.Cursor
+	}
+
+	request(e, http.MethodDelete, fmt.Sprintf("/todos/%d", a.ID), "")
+	ids, cursor := deleted("/todos/deleted")
+	if !slices.Equal(ids, []int{a.ID}) {
+		t.Fatalf("got %v, want [%d]", ids, a.ID)
+	}
+
+	request(e, http.MethodDelete, fmt.Sprintf("/todos/%d", b.ID), "")
+	request(e, http.MethodDelete, fmt.Sprintf("/todos/%d", c.ID), "")
+	// Deleting again must not record another tombstone.
+	if rec := request(e, http.MethodDelete, fmt.Sprintf("/todos/%d", c.ID), ""); rec.Code != http.StatusNoContent {
+		t.Errorf("repeated delete: got %d, want 204", rec.Code)
+	}
+	ids, next := deleted(fmt.Sprintf("/todos/deleted?since=%d", cursor))
+	if !slices.Equal(ids, []int{b.ID, c.ID}) {
+		t.Errorf("since %d: got %v, want [%d %d]", cursor, ids, b.ID, c.ID)
+	}
+	if ids, _ := deleted(fmt.Sprintf("/todos/deleted?since=%d", next)); len(ids) != 0 {
+		t.Errorf("since the latest cursor: got %v, want none", ids)
+	}
+
+	if rec := request(e, http.MethodGet, "/todos/deleted?since=-1", ""); rec.Code != http.StatusBadRequest {
+		t.Errorf("negative cursor: got %d, want 400", rec.Code)
+	}
+}
+
+func TestDBSpanAttributes(t *testing.T) {
+	recorder := recordSpans(t)
+	setupDB(t)
+	e := newTestServer(t)
+	request(e, http.MethodGet, "/todos", "")
+
+	span := endedSpan(t, recorder, "db SELECT")
+	if got, _ := spanAttribute(span, "db.system"); got.AsString() != "sqlite" {
+		t.Errorf("db.system = %q, want sqlite", got.AsString())
+	}
+	if got, _ := spanAttribute(span, "db.driver"); got.AsString() != "sqlite3" {
+		t.Errorf("db.driver = %q, want sqlite3", got.AsString())
+	}
+	if got, _ := spanAttribute(span, "db.version"); !strings.HasPrefix(got.AsString(), "3.") {
+		t.Errorf("db.version = %q, want a SQLite 3 version", got.AsString())
+	}
+	if span.SpanKind() != trace.SpanKindClient {
+		t.Errorf("span kind = %v, want client", span.SpanKind())
+	}
+}
+
+func TestErrorEnvelopeForRouting(t *testing.T) {
+	setupDB(t)
+	e := newTestServer(t)
+	tests := []struct {
+		method, target string
+		status         int
+		code           string
+	}{
+		{http.MethodGet, "/nope", http.StatusNotFound, "not_found"},
+		{http.MethodPatch, "/todos", http.StatusMethodNotAllowed, "method_not_allowed"},
+	}
+	for _, tt := range tests {
+		rec := request(e, tt.method, tt.target, "")
+		if rec.Code != tt.status {
+			t.Errorf("%s %s: got %d, want %d", tt.method, tt.target, rec.Code, tt.status)
+		}
+		var resp errorResponse
+		decodeBody(t, rec, &resp)
+		if resp.Code != tt.code || resp.Message == "" {
+			t.Errorf("%s %s: got envelope %+v, want code %s", tt.method, tt.target, resp, tt.code)
+		}
+	}
+}
+
+func TestRecordTodoAction(t *testing.T) {
+	// String constants cannot convert to a struct type, so a misspelled
+	// action is a compile error rather than a new series.
+	if kind := reflect.TypeOf(actionCreated).Kind(); kind != reflect.Struct {
+		t.Fatalf("todoAction is a %s, so untyped constants convert to it", kind)
+	}
+
+	for _, action := range []todoAction{actionCreated, actionUpdated, actionDeleted, actionPinned, actionUnpinned} {
+		counter := todoActionCount.WithLabelValues(action.label)
+		before := testutil.ToFloat64(counter)
+		recordTodoAction(action)
+		if got := testutil.ToFloat64(counter); got != before+1 {
+			t.Errorf("%s: counter went from %v to %v, want +1", action.label, before, got)
+		}
+	}
+}
+
+func TestLongPoll(t *testing.T) {
+	setupDB(t)
+	e := newTestServer(t)
+	version := request(e, http.MethodGet, "/todos", "").Header().Get("X-Todos-Version")
+
+	polled := make(chan *httptest.ResponseRecorder, 1)
+	start := time.Now()
+	go func() {
+		polled <- request(e, http.MethodGet, "/todos?wait=10s&version="+version, "")
+	}()
+	time.Sleep(50 * time.Millisecond)
+	createTestTodo(t, e, `{"title":"wake up"}`)
+
+	select {
+	case rec := <-polled:
+		if elapsed := time.Since(start); elapsed > 5*time.Second {
+			t.Errorf("poll took %s", elapsed)
+		}
+		var todos []TodoItem
+		decodeBody(t, rec, &todos)
+		if got := todoTitles(todos); !slices.Equal(got, []string{"wake up"}) {
+			t.Errorf("poll returned %q", got)
+		}
+		if got := rec.Header().Get("X-Todos-Version"); got == version {
+			t.Errorf("version stayed at %s", got)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("poll did not return after a create")
+	}
+
+	// A client that is behind is answered straight away.
+	start = time.Now()
+	request(e, http.MethodGet, "/todos?wait=10s&version="+version, "")
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("stale version waited %s", elapsed)
+	}
+}
+
+func TestLongPollCancellation(t *testing.T) {
+	setupDB(t)
+	e := newTestServer(t)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	req := httptest.NewRequest(http.MethodGet, "/todos?wait=10s", nil).WithContext(ctx)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		e.ServeHTTP(httptest.NewRecorder(), req)
+	}()
+	time.Sleep(50 * time.Millisecond)
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("poll kept waiting after the client went away")
+	}
+}
+
+func TestRefreshGauges(t *testing.T) {
+	setupDB(t)
+	t.Setenv("ADMIN_TOKEN", "secret")
+	e := newTestServer(t)
+	auth := []string{"Authorization", "Bearer secret"}
+
+	if rec := request(e, http.MethodPost, "/admin/refresh-gauges", "", auth...); rec.Code != http.StatusNoContent {
+		t.Fatalf("got %d %s", rec.Code, rec.Body)
+	}
+	if got := testutil.ToFloat64(todoItems.WithLabelValues("pending")); got != 0 {
+		t.Fatalf("pending = %v before any writes", got)
+	}
+
+	for _, title := range []string{"a", "b"} {
+		if _, err := db.Exec("INSERT INTO todos (title) VALUES (?)", title); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := db.Exec("INSERT INTO todos (title, completed) VALUES ('c', 1)"); err != nil {
+		t.Fatal(err)
+	}
+	if rec := request(e, http.MethodPost, "/admin/refresh-gauges", "", auth...); rec.Code != http.StatusNoContent {
+		t.Fatalf("got %d %s", rec.Code, rec.Body)
+	}
+	if got := testutil.ToFloat64(todoItems.WithLabelValues("pending")); got != 2 {
+		t.Errorf("pending = %v, want 2", got)
+	}
+	if got := testutil.ToFloat64(todoItems.WithLabelValues("completed")); got != 1 {
+		t.Errorf("completed = %v, want 1", got)
+	}
+}
+
+func TestMetricsDefaultFormat(t *testing.T) {
+	setupDB(t)
+	tests := []struct {
+		format, accept, want string
+	}{
+		{"classic", "application/x-unknown", "text/plain"},
+		{"openmetrics", "application/x-unknown", expfmt.OpenMetricsType},
+		{"openmetrics", "", expfmt.OpenMetricsType},
+		// A recognized Accept header is still negotiated as usual.
+		{"openmetrics", "text/plain", "text/plain"},
+	}
+	for _, tt := range tests {
+		t.Setenv("METRICS_DEFAULT_FORMAT", tt.format)
+		e := newTestServer(t)
+		for _, path := range []string{"/metrics", "/metrics/app"} {
+			rec := request(e, http.MethodGet, path, "", "Accept", tt.accept)
+			if got := rec.Header().Get(echo.HeaderContentType); !strings.HasPrefix(got, tt.want) {
+				t.Errorf("%s with %s and Accept %q: got %s, want %s", path, tt.format, tt.accept, got, tt.want)
+			}
+		}
+	}
+
+	t.Setenv("METRICS_DEFAULT_FORMAT", "protobuf")
+	if _, err := newServer(); err == nil {
+		t.Error("an unknown METRICS_DEFAULT_FORMAT was accepted")
+	}
+}
+
+func TestHeadTodosCount(t *testing.T) {
+	setupDB(t)
+	e := newTestServer(t)
+	createTestTodo(t, e, `{"title":"a"}`)
+	createTestTodo(t, e, `{"title":"b"}`)
+
+	rec := request(e, http.MethodHead, "/todos", "")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("got %d", rec.Code)
+	}
+	if got := rec.Header().Get("X-Total-Count"); got != "2" {
+		t.Errorf("X-Total-Count = %q, want 2", got)
+	}
+	if rec.Body.Len() != 0 {
+		t.Errorf("HEAD returned a body: %q", rec.Body)
+	}
+}
+
+func TestStmtCachePreparesOnce(t *testing.T) {
+	setupDB(t)
+	setForTest(t, &stmts, newStmtCache())
+	e := newTestServer(t)
+
+	for i := 0; i < 20; i++ {
+		createTestTodo(t, e, fmt.Sprintf(`{"title":"todo %d"}`, i))
+		request(e, http.MethodGet, "/todos", "")
+	}
+	// One insert and one list statement.
+	if got := len(stmts.stmts); got != 2 {
+		t.Errorf("cache holds %d statements, want 2", got)
+	}
+
+	query := "SELECT " + todoColumns + " FROM todos ORDER BY pinned DESC, id"
+	first, err := stmts.prepare(context.Background(), query)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again, _ := stmts.prepare(context.Background(), query); again != first {
+		t.Error("the same query was prepared twice")
+	}
+
+	stmts.close()
+	if got := len(stmts.stmts); got != 0 {
+		t.Errorf("close left %d statements", got)
+	}
+}
+
+func TestStmtCacheCoversReadPaths(t *testing.T) {
+	setForTest(t, &enabledFeatures, map[string]bool{"board": true})
+	setForTest(t, &uniqueTitles, true)
+	setupDB(t)
+	setForTest(t, &stmts, newStmtCache())
+	t.Setenv("ADMIN_TOKEN", "secret")
+	e := newTestServer(t)
+	todo := createTestTodo(t, e, `{"title":"cached"}`)
+
+	tests := []struct {
+		method, target string
+	}{
+		{http.MethodGet, "/todos?modified_since=2000-01-01T00:00:00Z"},
+		{http.MethodGet, "/todos/export"},
+		{http.MethodGet, "/todos/board"},
+		{http.MethodHead, "/todos"},
+		{http.MethodGet, "/todos/deleted"},
+		{http.MethodPut, "/todos?by=title"},
+		{http.MethodPost, fmt.Sprintf("/todos/%d/pin", todo.ID)},
+		{http.MethodDelete, fmt.Sprintf("/todos/%d", todo.ID)},
+		{http.MethodPost, "/admin/gc?older_than=1h"},
+	}
+	for _, tt := range tests {
+		before := len(stmts.stmts)
+		rec := request(e, tt.method, tt.target, `{"title":"cached"}`, "Authorization", "Bearer secret")
+		if rec.Code >= 300 {
+			t.Fatalf("%s %s: got %d %s", tt.method, tt.target, rec.Code, rec.Body)
+		}
+		if len(stmts.stmts) == before {
+			t.Errorf("%s %s prepared no cached statement", tt.method, tt.target)
+		}
+	}
+}
+
+func TestStatusTransitions(t *testing.T) {
+	setForTest(t, &uniqueTitles, true)
+	setupDB(t)
+	e := newTestServer(t)
+	tests := []struct {
+		from, update string
+		want         int
+		status       string
+	}{
+		{statusTodo, `"status":"in_progress"`, http.StatusOK, statusInProgress},
+		{statusTodo, `"status":"done"`, http.StatusOK, statusDone},
+		{statusInProgress, `"status":"done"`, http.StatusOK, statusDone},
+		{statusInProgress, `"completed":false`, http.StatusOK, statusInProgress},
+		{statusDone, `"status":"todo"`, http.StatusOK, statusTodo},
+		{statusDone, `"status":"in_progress"`, http.StatusConflict, ""},
+		{statusTodo, `"completed":true`, http.StatusOK, statusDone},
+		{statusTodo, `"status":"blocked"`, http.StatusUnprocessableEntity, ""},
+	}
+	for i, tt := range tests {
+		title := fmt.Sprintf("transition %d", i)
+		body := fmt.Sprintf(`{"title":%q,"status":%q}`, title, tt.from)
+		if rec := request(e, http.MethodPut, "/todos?by=title", body); rec.Code != http.StatusCreated {
+			t.Fatalf("create %s: got %d %s", tt.from, rec.Code, rec.Body)
+		}
+
+		rec := request(e, http.MethodPut, "/todos?by=title", fmt.Sprintf(`{"title":%q,%s}`, title, tt.update))
+		if rec.Code != tt.want {
+			t.Errorf("%s with %s: got %d %s, want %d", tt.from, tt.update, rec.Code, rec.Body, tt.want)
+			continue
+		}
+		if tt.status == "" {
+			continue
+		}
+		var todo TodoItem
+		decodeBody(t, rec, &todo)
+		if todo.Status != tt.status || todo.Completed != (tt.status == statusDone) {
+			t.Errorf("%s with %s: got status %s completed %t, want %s", tt.from, tt.update, todo.Status, todo.Completed, tt.status)
+		}
+	}
+}
+
+func TestOldestPendingAge(t *testing.T) {
+	setupDB(t)
+	ctx := context.Background()
+
+	for _, tt := range []struct {
+		nan  bool
+		want float64
+	}{{false, 0}, {true, math.NaN()}} {
+		setForTest(t, &oldestPendingEmptyNaN, tt.nan)
+		if err := refreshGauges(ctx); err != nil {
+			t.Fatal(err)
+		}
+		if got := testutil.ToFloat64(oldestPending); got != tt.want && !(math.IsNaN(got) && math.IsNaN(tt.want)) {
+			t.Errorf("empty backlog with NaN=%t: got %v, want %v", tt.nan, got, tt.want)
+		}
+	}
+
+	now := time.Now().UTC()
+	seed := []struct {
+		age       time.Duration
+		completed bool
+	}{
+		{time.Hour, false},
+		{3 * time.Hour, false},
+		// Completed todos do not count, however old.
+		{48 * time.Hour, true},
+	}
+	for _, s := range seed {
+		_, err := db.Exec("INSERT INTO todos (title, completed, created_at) VALUES ('seed', ?, ?)",
+			s.completed, now.Add(-s.age).Format(sqliteTimeLayout))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := refreshGauges(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if got := testutil.ToFloat64(oldestPending); math.Abs(got-3*3600) > 5 {
+		t.Errorf("oldest pending age = %v, want about %v", got, 3*3600)
+	}
+}
+
+func TestCreateDedupeWindow(t *testing.T) {
+	tests := []struct {
+		name   string
+		window time.Duration
+		bodies []string
+		rows   int
+	}{
+		{"disabled", 0, []string{`{"title":"a"}`, `{"title":"a"}`}, 2},
+		{"identical", time.Minute, []string{`{"title":"a","description":"x"}`, `{"title":"a","description":"x"}`}, 1},
+		{"different description", time.Minute, []string{`{"title":"a","description":"x"}`, `{"title":"a","description":"y"}`}, 2},
+		{"absent and empty description", time.Minute, []string{`{"title":"a"}`, `{"title":"a","description":""}`}, 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setupDB(t)
+			var dedupe *createDeduper
+			if tt.window > 0 {
+				dedupe = newCreateDeduper(tt.window)
+			}
+			setForTest(t, &createDedupe, dedupe)
+			e := newTestServer(t)
+
+			var ids []int
+			for _, body := range tt.bodies {
+				ids = append(ids, createTestTodo(t, e, body).ID)
+			}
+			var rows int
+			if err := db.QueryRow("SELECT COUNT(*) FROM todos").Scan(&rows); err != nil {
+				t.Fatal(err)
+			}
+			if rows != tt.rows {
+				t.Errorf("got %d rows, want %d", rows, tt.rows)
+			}
+			if tt.rows == 1 && ids[0] != ids[1] {
+				t.Errorf("duplicate create returned id %d, want %d", ids[1], ids[0])
+			}
+		})
+	}
+}
+
+func TestServerTime(t *testing.T) {
+	setupDB(t)
+	tokyo, err := time.LoadLocation("Asia/Tokyo")
+	if err != nil {
+		t.Skipf("no tzdata: %v", err)
+	}
+	setForTest(t, &location, tokyo)
+	e := newTestServer(t)
+
+	rec := request(e, http.MethodGet, "/time", "")
+	var resp struct {
+		Time     string `json:"time"`
+		Timezone string `json:"timezone"`
+	}
+	decodeBody(t, rec, &resp)
+	got, err := time.Parse(time.RFC3339, resp.Time)
+	if err != nil {
+		t.Fatalf("time %q does not parse: %v", resp.Time, err)
+	}
+	// RFC3339 drops the fraction, so compare whole seconds.
+	if d := time.Now().Truncate(time.Second).Sub(got); d < 0 || d > time.Second {
+		t.Errorf("time is %s off", d)
+	}
+	if _, offset := got.Zone(); offset != 9*3600 {
+		t.Errorf("time %s is not in the configured timezone", resp.Time)
+	}
+	if resp.Timezone != "Asia/Tokyo" {
+		t.Errorf("timezone = %q, want Asia/Tokyo", resp.Timezone)
+	}
+}
+
+func histogramCount(t *testing.T, observer prometheus.Observer) uint64 {
+	t.Helper()
+	var m dto.Metric
+	if err := observer.(prometheus.Metric).Write(&m); err != nil {
+		t.Fatal(err)
+	}
+	return m.GetHistogram().GetSampleCount()
+}
+
+func TestDBSpanSampleRatio(t *testing.T) {
+	setupDB(t)
+	e := newTestServer(t)
+	for _, ratio := range []float64{0, 1} {
+		setForTest(t, &dbSpanSampleRatio, ratio)
+		recorder := recordSpans(t)
+		before := histogramCount(t, dbQueryDuration.WithLabelValues("SELECT"))
+
+		request(e, http.MethodGet, "/todos", "")
+
+		dbSpans := 0
+		for _, span := range recorder.Ended() {
+			if strings.HasPrefix(span.Name(), "db ") {
+				dbSpans++
+			}
+		}
+		if want := int(ratio); dbSpans != want {
+			t.Errorf("ratio %v: got %d DB spans, want %d", ratio, dbSpans, want)
+		}
+		if got := histogramCount(t, dbQueryDuration.WithLabelValues("SELECT")); got != before+1 {
+			t.Errorf("ratio %v: duration samples went from %d to %d, want +1", ratio, before, got)
+		}
+	}
+}
+
+func TestLimitValidation(t *testing.T) {
+	setForTest(t, &enabledFeatures, map[string]bool{"board": true})
+	setupDB(t)
+	e := newTestServer(t)
+	tests := []struct {
+		limit string
+		want  int
+	}{
+		{"1", http.StatusOK},
+		{"1000", http.StatusOK},
+		{"1001", http.StatusBadRequest},
+		{"0", http.StatusBadRequest},
+		{"-1", http.StatusBadRequest},
+		{"2147483648", http.StatusBadRequest},
+		{"99999999999999999999", http.StatusBadRequest},
+		{"ten", http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		if rec := request(e, http.MethodGet, "/todos/board?limit="+tt.limit, ""); rec.Code != tt.want {
+			t.Errorf("limit=%s: got %d, want %d", tt.limit, rec.Code, tt.want)
+		}
+	}
+}
+
+func TestMetricsRegistrySplit(t *testing.T) {
+	setupDB(t)
+	e := newTestServer(t)
+	tests := []struct {
+		path        string
+		present     []string
+		notExported []string
+	}{
+		{"/metrics", []string{"go_goroutines", "go_memstats_alloc_bytes"}, []string{"http_in_flight_requests", "db_active_transactions"}},
+		{"/metrics/app", []string{"http_in_flight_requests", "db_active_transactions"}, []string{"go_goroutines", "go_memstats_alloc_bytes"}},
+	}
+	for _, tt := range tests {
+		rec := request(e, http.MethodGet, tt.path, "")
+		families, err := new(expfmt.TextParser).TextToMetricFamilies(rec.Body)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.path, err)
+		}
+		for _, name := range tt.present {
+			if _, ok := families[name]; !ok {
+				t.Errorf("%s is missing %s", tt.path, name)
+			}
+		}
+		for _, name := range tt.notExported {
+			if _, ok := families[name]; ok {
+				t.Errorf("%s exposes %s", tt.path, name)
+			}
+		}
+	}
+}
+
+func TestSamplerDropsAppMetricsByDefault(t *testing.T) {
+	_, recorder := tracerFromInit(t)
+	setupDB(t)
+	e := newTestServer(t)
+	request(e, http.MethodGet, "/metrics/app", "")
+	if recordedPaths(recorder)["/metrics/app"] {
+		t.Error("span recorded for /metrics/app")
+	}
+}
+
+func TestDescriptionLimit(t *testing.T) {
+	setForTest(t, &maxDescriptionLength, 5)
+	setupDB(t)
+	e := newTestServer(t)
+
+	createTestTodo(t, e, `{"title":"ok","description":"12345"}`)
+	rec := request(e, http.MethodPost, "/todos", `{"title":"long","description":"123456"}`)
+	if rec.Code != http.StatusUnprocessableEntity {
+		t.Errorf("API: got %d, want 422", rec.Code)
+	}
+	var resp errorResponse
+	decodeBody(t, rec, &resp)
+	if resp.Fields["description"] == "" {
+		t.Errorf("API: no description field error in %+v", resp)
+	}
+
+	_, err := db.Exec("INSERT INTO todos (title, description) VALUES ('direct', '123456')")
+	if !isDescriptionTooLong(err) {
+		t.Errorf("direct insert: got %v, want the description trigger to abort", err)
+	}
+	_, err = db.Exec("UPDATE todos SET description = '123456'")
+	if !isDescriptionTooLong(err) {
+		t.Errorf("direct update: got %v, want the description trigger to abort", err)
+	}
+
+	// A write that skips API validation is still answered with a 422.
+	description := "123456"
+	_, err = insertTodo(context.Background(), TodoItem{Title: "bypass", Description: &description, Status: statusTodo})
+	var ve *validationError
+	if !errors.As(err, &ve) {
+		t.Errorf("insertTodo: got %v, want a validation error", err)
+	}
+}
+
+func TestModifiedSince(t *testing.T) {
+	recorder := recordSpans(t)
+	setupDB(t)
+	e := newTestServer(t)
+	gone := createTestTodo(t, e, `{"title":"gone"}`)
+	createTestTodo(t, e, `{"title":"unchanged"}`)
+	pinned := createTestTodo(t, e, `{"title":"pinned"}`)
+
+	// The later writes usually land in the same second as the cutoff.
+	time.Sleep(5 * time.Millisecond)
+	since := time.Now()
+	time.Sleep(5 * time.Millisecond)
+	createTestTodo(t, e, `{"title":"new"}`)
+	request(e, http.MethodPost, fmt.Sprintf("/todos/%d/pin", pinned.ID), "")
+	request(e, http.MethodDelete, fmt.Sprintf("/todos/%d", gone.ID), "")
+
+	rec := request(e, http.MethodGet, "/todos?modified_since="+url.QueryEscape(since.Format(time.RFC3339Nano)), "")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("got %d %s", rec.Code, rec.Body)
+	}
+	var resp struct {
+		Todos   []TodoItem `json:"todos"`
+		Deleted []int      `json:"deleted"`
+	}
+	decodeBody(t, rec, &resp)
+	// Writes in the same millisecond share updated_at, so order is not checked.
+	got := todoTitles(resp.Todos)
+	slices.Sort(got)
+	if !slices.Equal(got, []string{"new", "pinned"}) {
+		t.Errorf("todos = %q, want [new pinned]", got)
+	}
+	if !slices.Equal(resp.Deleted, []int{gone.ID}) {
+		t.Errorf("deleted = %v, want [%d]", resp.Deleted, gone.ID)
+	}
+	if _, ok := spanAttribute(endedSpan(t, recorder, "getTodosModifiedSince"), "todo.modified_since"); !ok {
+		t.Error("span has no todo.modified_since attribute")
+	}
+
+	if rec := request(e, http.MethodGet, "/todos?modified_since=yesterday", ""); rec.Code != http.StatusBadRequest {
+		t.Errorf("invalid timestamp: got %d, want 400", rec.Code)
+	}
+}
+
+func TestOTLPEndpoint(t *testing.T) {
+	paths := make(chan string, 1)
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		paths <- r.URL.Path
+	})
+	plain := httptest.NewServer(handler)
+	defer plain.Close()
+	secure := httptest.NewTLSServer(handler)
+	defer secure.Close()
+
+	// The exporter trusts the test server's certificate through the SDK's
+	// own setting, so a successful export over https proves TLS was used.
+	caFile := filepath.Join(t.TempDir(), "ca.pem")
+	ca := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: secure.Certificate().Raw})
+	if err := os.WriteFile(caFile, ca, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("OTEL_EXPORTER_OTLP_CERTIFICATE", caFile)
+
+	tests := []struct {
+		endpoint, path string
+	}{
+		{strings.TrimPrefix(plain.URL, "http://"), "/v1/traces"},
+		{plain.URL, "/v1/traces"},
+		{plain.URL + "/otlp/", "/otlp/v1/traces"},
+		{secure.URL, "/v1/traces"},
+	}
+	for _, tt := range tests {
+		opts, err := otlpOptions(tt.endpoint)
+		if err != nil {
+			t.Errorf("%s: %v", tt.endpoint, err)
+			continue
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		exporter, err := otlptracehttp.New(ctx, append(opts, otlptracehttp.WithRetry(otlptracehttp.RetryConfig{}))...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		span := tracetest.SpanStub{Name: "test"}.Snapshot()
+		if err := exporter.ExportSpans(ctx, []sdktrace.ReadOnlySpan{span}); err != nil {
+			t.Errorf("%s: export failed: %v", tt.endpoint, err)
+		} else if got := <-paths; got != tt.path {
+			t.Errorf("%s: exported to %s, want %s", tt.endpoint, got, tt.path)
+		}
+		exporter.Shutdown(ctx)
+		cancel()
+	}
+
+	for _, endpoint := range []string{"ftp://collector:4318", "http://"} {
+		if _, err := otlpOptions(endpoint); err == nil {
+			t.Errorf("%s was accepted", endpoint)
+		}
+	}
+}
+
+func TestRouteInFlight(t *testing.T) {
+	e := echo.New()
+	e.Use(trackInFlight)
+	release := make(chan struct{})
+	blocked := func(c echo.Context) error {
+		<-release
+		return c.NoContent(http.StatusNoContent)
+	}
+	e.GET("/slow/a", blocked)
+	e.GET("/slow/b", blocked)
+
+	var wg sync.WaitGroup
+	for path, n := range map[string]int{"/slow/a": 2, "/slow/b": 1} {
+		for i := 0; i < n; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				request(e, http.MethodGet, path, "")
+			}()
+		}
+	}
+
+	want := map[string]float64{"/slow/a": 2, "/slow/b": 1}
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		got := map[string]float64{
+			"/slow/a": testutil.ToFloat64(routeInFlight.WithLabelValues("/slow/a")),
+			"/slow/b": testutil.ToFloat64(routeInFlight.WithLabelValues("/slow/b")),
+		}
+		if maps.Equal(got, want) {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("in flight = %v, want %v", got, want)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	close(release)
+	wg.Wait()
+	for path := range want {
+		if got := testutil.ToFloat64(routeInFlight.WithLabelValues(path)); got != 0 {
+			t.Errorf("%s in flight = %v after the requests finished", path, got)
+		}
+	}
+}
+
+func TestMalformedVersusInvalidBodies(t *testing.T) {
+	setForTest(t, &uniqueTitles, true)
+	setupDB(t)
+	e := newTestServer(t)
+	tests := []struct {
+		name, body string
+		want       int
+		field      string
+	}{
+		{"malformed", `{"title":`, http.StatusBadRequest, ""},
+		{"wrong type", `{"title":1}`, http.StatusBadRequest, ""},
+		{"missing title", `{"description":"x"}`, http.StatusUnprocessableEntity, "title"},
+		{"blank title", `{"title":"  "}`, http.StatusUnprocessableEntity, "title"},
+		{"unknown status", `{"title":"a","status":"blocked"}`, http.StatusUnprocessableEntity, "status"},
+	}
+	for _, tt := range tests {
+		for _, target := range []string{"/todos", "/todos?by=title"} {
+			method := http.MethodPost
+			if target != "/todos" {
+				method = http.MethodPut
+			}
+			rec := request(e, method, target, tt.body)
+			if rec.Code != tt.want {
+				t.Errorf("%s %s: got %d, want %d", method, tt.name, rec.Code, tt.want)
+				continue
+			}
+			var resp errorResponse
+			decodeBody(t, rec, &resp)
+			if tt.field != "" && resp.Fields[tt.field] == "" {
+				t.Errorf("%s %s: no %s field error in %+v", method, tt.name, tt.field, resp)
+			}
+		}
+	}
+}
+
+func TestWarmupConns(t *testing.T) {
+	tests := []struct {
+		warmup, maxOpen string
+		want            int
+	}{
+		{"3", "0", 3},
+		{"5", "2", 2},
+		{"0", "0", 1}, // initDB itself leaves one connection idle
+	}
+	for _, tt := range tests {
+		t.Setenv("DB_WARMUP_CONNS", tt.warmup)
+		t.Setenv("DB_MAX_OPEN_CONNS", tt.maxOpen)
+		setupDB(t)
+		if got := db.Stats().OpenConnections; got != tt.want {
+			t.Errorf("warmup %s, max %s: %d open connections, want %d", tt.warmup, tt.maxOpen, got, tt.want)
+		}
+		db.Close()
+	}
+}
+
+func TestSpanRouteTemplate(t *testing.T) {
+	recorder := recordSpans(t)
+	setupDB(t)
+	e := newTestServer(t)
+	todo := createTestTodo(t, e, `{"title":"route"}`)
+	if rec := request(e, http.MethodDelete, fmt.Sprintf("/todos/%d", todo.ID), ""); rec.Code != http.StatusNoContent {
+		t.Fatalf("delete: got %d", rec.Code)
+	}
+
+	span := endedSpan(t, recorder, "DELETE /todos/:id")
+	if got, _ := spanAttribute(span, "http.route"); got.AsString() != "/todos/:id" {
+		t.Errorf("http.route = %q, want /todos/:id", got.AsString())
+	}
+	if got, _ := spanAttribute(span, "url.path"); got.AsString() != fmt.Sprintf("/todos/%d", todo.ID) {
+		t.Errorf("url.path = %q, want the concrete path", got.AsString())
+	}
+}
+
+func TestBackupBeforeMigrate(t *testing.T) {
+	for _, enabled := range []bool{true, false} {
+		t.Setenv("BACKUP_BEFORE_MIGRATE", fmt.Sprint(enabled))
+		setupDB(t)
+		db.Close()
+		before, _ := filepath.Glob(dbPath + ".*.bak")
+		if len(before) != 0 {
+			t.Fatalf("backup created for a new database: %v", before)
+		}
+		// Reopening the now-existing file runs the migrations again.
+		if err := initDB(); err != nil {
+			t.Fatal(err)
+		}
+		db.Close()
+		backups, _ := filepath.Glob(dbPath + ".*.bak")
+		if enabled && len(backups) != 1 || !enabled && len(backups) != 0 {
+			t.Errorf("BACKUP_BEFORE_MIGRATE=%v: backups %v", enabled, backups)
+		}
+	}
+}
+
+func TestHeaderLimits(t *testing.T) {
+	setupDB(t)
+	t.Setenv("HTTP_MAX_HEADER_BYTES", "1024")
+	t.Setenv("HTTP_MAX_HEADER_FIELDS", "10")
+	e := newTestServer(t)
+	srv := httptest.NewUnstartedServer(e)
+	srv.Config.MaxHeaderBytes = e.Server.MaxHeaderBytes
+	srv.Start()
+	t.Cleanup(srv.Close)
+
+	tests := []struct {
+		name   string
+		header http.Header
+		want   int
+	}{
+		{"within limits", http.Header{"X-Small": {"a"}}, http.StatusOK},
+		// net/http allows 4096 bytes of slack over MaxHeaderBytes.
+		{"oversized", http.Header{"X-Big": {strings.Repeat("a", 8<<10)}}, http.StatusRequestHeaderFieldsTooLarge},
+		{"too many fields", func() http.Header {
+			h := http.Header{}
+			for i := range 20 {
+				h.Set(fmt.Sprintf("X-Field-%d", i), "a")
+			}
+			return h
+		}(), http.StatusRequestHeaderFieldsTooLarge},
+	}
+	for _, tt := range tests {
+		req, _ := http.NewRequest(http.MethodGet, srv.URL+"/todos", nil)
+		req.Header = tt.header
+		req.Close = true
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != tt.want {
+			t.Errorf("%s: got %d, want %d", tt.name, resp.StatusCode, tt.want)
+		}
+	}
+	if e.Server.ReadHeaderTimeout != 10*time.Second {
+		t.Errorf("ReadHeaderTimeout = %v, want the 10s default", e.Server.ReadHeaderTimeout)
+	}
+}
+
+func TestActiveTransactionsGauge(t *testing.T) {
+	setupDB(t)
+	for _, commit := range []bool{true, false} {
+		tx, err := beginTx(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := testutil.ToFloat64(dbActiveTx); got != 1 {
+			t.Errorf("gauge = %v with an open transaction, want 1", got)
+		}
+		if commit {
+			err = tx.Commit()
+		} else {
+			err = tx.Rollback()
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		// The usual deferred Rollback after Commit must not decrement again.
+		tx.Rollback()
+		if got := testutil.ToFloat64(dbActiveTx); got != 0 {
+			t.Errorf("commit=%v: gauge = %v after the transaction ended, want 0", commit, got)
+		}
+	}
+}
+
+func TestEmptyListIsArray(t *testing.T) {
+	setupDB(t)
+	e := newTestServer(t)
+	rec := request(e, http.MethodGet, "/todos", "")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("got %d, want 200", rec.Code)
+	}
+	if got := strings.TrimSpace(rec.Body.String()); got != "[]" {
+		t.Errorf("empty table body = %s, want []", got)
+	}
+}
+
+func TestRequestLogCorrelation(t *testing.T) {
+	recorder := recordSpans(t)
+	setupDB(t)
+	e := newTestServer(t)
+	var buf bytes.Buffer
+	e.Logger.SetOutput(&buf)
+	request(e, http.MethodGet, "/todos", "", "X-Request-ID", "req-243")
+
+	var line struct {
+		RequestID string `json:"request_id"`
+		TraceID   string `json:"trace_id"`
+	}
+	if err := json.Unmarshal(buf.Bytes(), &line); err != nil {
+		t.Fatalf("log line %q: %v", buf.String(), err)
+	}
+	span := endedSpan(t, recorder, "GET /todos")
+	if line.TraceID != span.SpanContext().TraceID().String() {
+		t.Errorf("trace_id = %q, want %s", line.TraceID, span.SpanContext().TraceID())
+	}
+	if line.RequestID != "req-243" {
+		t.Errorf("request_id = %q, want req-243", line.RequestID)
+	}
+}
+
+func TestPinnedTodos(t *testing.T) {
+	setupDB(t)
+	e := newTestServer(t)
+	for _, title := range []string{"a", "b", "c"} {
+		createTestTodo(t, e, fmt.Sprintf(`{"title":%q}`, title))
+	}
+	list := func() []string {
+		t.Helper()
+		var todos []TodoItem
+		decodeBody(t, request(e, http.MethodGet, "/todos", ""), &todos)
+		return todoTitles(todos)
+	}
+	pinned := todoActionCount.WithLabelValues(actionPinned.label)
+	unpinned := todoActionCount.WithLabelValues(actionUnpinned.label)
+	pinnedBefore, unpinnedBefore := testutil.ToFloat64(pinned), testutil.ToFloat64(unpinned)
+
+	rec := request(e, http.MethodPost, "/todos/3/pin", "")
+	var todo TodoItem
+	decodeBody(t, rec, &todo)
+	if rec.Code != http.StatusOK || !todo.Pinned {
+		t.Fatalf("pin: got %d %+v", rec.Code, todo)
+	}
+	if got := list(); !slices.Equal(got, []string{"c", "a", "b"}) {
+		t.Errorf("after pin: %q, want [c a b]", got)
+	}
+	if rec := request(e, http.MethodDelete, "/todos/3/pin", ""); rec.Code != http.StatusOK {
+		t.Fatalf("unpin: got %d", rec.Code)
+	}
+	if got := list(); !slices.Equal(got, []string{"a", "b", "c"}) {
+		t.Errorf("after unpin: %q, want [a b c]", got)
+	}
+	if rec := request(e, http.MethodPost, "/todos/99/pin", ""); rec.Code != http.StatusNotFound {
+		t.Errorf("pin missing todo: got %d, want 404", rec.Code)
+	}
+	if got := testutil.ToFloat64(pinned) - pinnedBefore; got != 1 {
+		t.Errorf("pinned actions += %v, want 1", got)
+	}
+	if got := testutil.ToFloat64(unpinned) - unpinnedBefore; got != 1 {
+		t.Errorf("unpinned actions += %v, want 1", got)
+	}
+}
+
+func TestExportFormats(t *testing.T) {
+	setupDB(t)
+	e := newTestServer(t)
+	createTestTodo(t, e, `{"title":"a","description":"x"}`)
+	createTestTodo(t, e, `{"title":"b"}`)
+
+	tests := []struct {
+		query, contentType, filename string
+		check                        func(body string) error
+	}{
+		{"", "application/json; charset=UTF-8", "todos.json", func(body string) error {
+			var todos []TodoItem
+			if err := json.Unmarshal([]byte(body), &todos); err != nil {
+				return err
+			}
+			if got := todoTitles(todos); !slices.Equal(got, []string{"a", "b"}) {
+				return fmt.Errorf("titles %q", got)
+			}
+			return nil
+		}},
+		{"?format=ndjson", "application/x-ndjson", "todos.ndjson", func(body string) error {
+			lines := strings.Split(strings.TrimSpace(body), "\n")
+			if len(lines) != 2 {
+				return fmt.Errorf("%d lines", len(lines))
+			}
+			var todo TodoItem
+			return json.Unmarshal([]byte(lines[1]), &todo)
+		}},
+		{"?format=csv", "text/csv; charset=utf-8", "todos.csv", func(body string) error {
+			want := "id,title,description,completed,status,pinned\n1,a,x,false,todo,false\n2,b,,false,todo,false\n"
+			if body != want {
+				return fmt.Errorf("body %q", body)
+			}
+			return nil
+		}},
+	}
+	for _, tt := range tests {
+		rec := request(e, http.MethodGet, "/todos/export"+tt.query, "")
+		if rec.Code != http.StatusOK {
+			t.Errorf("%q: got %d", tt.query, rec.Code)
+			continue
+		}
+		if got := rec.Header().Get(echo.HeaderContentType); got != tt.contentType {
+			t.Errorf("%q: content type %q, want %q", tt.query, got, tt.contentType)
+		}
+		if got := rec.Header().Get(echo.HeaderContentDisposition); !strings.Contains(got, tt.filename) {
+			t.Errorf("%q: disposition %q, want %s", tt.query, got, tt.filename)
+		}
+		if err := tt.check(rec.Body.String()); err != nil {
+			t.Errorf("%q: %v", tt.query, err)
+		}
+	}
+	if rec := request(e, http.MethodGet, "/todos/export?format=xml", ""); rec.Code != http.StatusBadRequest {
+		t.Errorf("format=xml: got %d, want 400", rec.Code)
+	}
+}
+
+func TestExportMemStatsAttributes(t *testing.T) {
+	setupDB(t)
+	e := newTestServer(t)
+	for _, enabled := range []bool{false, true} {
+		recorder := recordSpans(t)
+		setForTest(t, &traceMemStats, enabled)
+		request(e, http.MethodGet, "/todos/export", "")
+		span := endedSpan(t, recorder, "exportTodos")
+		for _, key := range []attribute.Key{"memory.alloc_bytes", "memory.mallocs"} {
+			got, ok := spanAttribute(span, key)
+			if ok != enabled {
+				t.Errorf("TRACE_MEM_STATS=%v: %s present = %v", enabled, key, ok)
+			}
+			if enabled && got.AsInt64() <= 0 {
+				t.Errorf("%s = %d, want > 0", key, got.AsInt64())
+			}
+		}
+	}
+}
+
+func TestServiceNameOverride(t *testing.T) {
+	for _, tt := range []struct{ env, want string }{{"", "todo-service"}, {"todo-green", "todo-green"}} {
+		t.Setenv("OTEL_SERVICE_NAME", tt.env)
+		_, recorder := tracerFromInit(t)
+		_, span := tracer.Start(context.Background(), "probe")
+		span.End()
+		got := endedSpan(t, recorder, "probe").Resource()
+		if v, _ := got.Set().Value("service.name"); v.AsString() != tt.want {
+			t.Errorf("OTEL_SERVICE_NAME=%q: service.name = %q, want %q", tt.env, v.AsString(), tt.want)
+		}
+	}
+}
+
+func TestDBFileSizeGauge(t *testing.T) {
+	setupDB(t)
+	dbFileSize.Set(0)
+	e := newTestServer(t)
+	createTestTodo(t, e, `{"title":"size"}`)
+	if err := refreshGauges(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	info, err := os.Stat(dbPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := testutil.ToFloat64(dbFileSize); got == 0 || got != float64(info.Size()) {
+		t.Errorf("db_file_size_bytes = %v, want the file size %d", got, info.Size())
+	}
+
+	// In-memory databases have no file and leave the gauge alone.
+	setForTest(t, &dbPath, ":memory:")
+	dbFileSize.Set(0)
+	if err := refreshGauges(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if got := testutil.ToFloat64(dbFileSize); got != 0 {
+		t.Errorf("in-memory db_file_size_bytes = %v, want 0", got)
+	}
+}
+
+func TestPurgeTombstones(t *testing.T) {
+	setupDB(t)
+	t.Setenv("ADMIN_TOKEN", "secret")
+	e := newTestServer(t)
+	auth := []string{"Authorization", "Bearer secret"}
+	_, err := db.Exec(`INSERT INTO todo_tombstones (todo_id, deleted_at) VALUES
+		(101, datetime('now', '-40 days')), (102, datetime('now', '-31 days')), (103, datetime('now', '-1 day'))`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	todo := createTestTodo(t, e, `{"title":"recent"}`)
+	request(e, http.MethodDelete, fmt.Sprintf("/todos/%d", todo.ID), "")
+
+	for _, bad := range []string{"", "soon", "-3d", "0h"} {
+		if rec := request(e, http.MethodPost, "/admin/gc?older_than="+bad, "", auth...); rec.Code != http.StatusBadRequest {
+			t.Errorf("older_than=%q: got %d, want 400", bad, rec.Code)
+		}
+	}
+	rec := request(e, http.MethodPost, "/admin/gc?older_than=30d", "", auth...)
+	var resp struct {
+		Purged int64 `json:"purged"`
+	}
+	decodeBody(t, rec, &resp)
+	if rec.Code != http.StatusOK || resp.Purged != 2 {
+		t.Fatalf("got %d, purged %d, want 2", rec.Code, resp.Purged)
+	}
+	var left []int
+	rows, err := db.Query("SELECT todo_id FROM todo_tombstones ORDER BY todo_id")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var id int
+		rows.Scan(&id)
+		left = append(left, id)
+	}
+	if !slices.Equal(left, []int{todo.ID, 103}) {
+		t.Errorf("remaining tombstones %v, want [%d 103]", left, todo.ID)
+	}
+	if rec := request(e, http.MethodPost, "/admin/gc?older_than=30d", ""); rec.Code != http.StatusUnauthorized {
+		t.Errorf("without token: got %d, want 401", rec.Code)
+	}
+}
+
+func TestCacheControl(t *testing.T) {
+	setupDB(t)
+	t.Setenv("CACHE_CONTROL", "/time=max-age=60; /todos=")
+	e := newTestServer(t)
+	tests := []struct {
+		method, target, want string
+	}{
+		{http.MethodGet, "/time", "max-age=60"},
+		{http.MethodGet, "/todos/export", "no-store"},
+		{http.MethodGet, "/todos", ""},
+		{http.MethodGet, "/todos/deleted", "no-cache"},
+		{http.MethodGet, "/todos/99", ""},
+		{http.MethodPost, "/todos", ""},
+	}
+	for _, tt := range tests {
+		rec := request(e, tt.method, tt.target, "")
+		if got := rec.Header().Get(echo.HeaderCacheControl); got != tt.want {
+			t.Errorf("%s %s: Cache-Control %q, want %q", tt.method, tt.target, got, tt.want)
+		}
+	}
+}
+
+type failingCollector struct {
+	desc  *prometheus.Desc
+	panic bool
+}
+
+func (f failingCollector) Describe(ch chan<- *prometheus.Desc) { ch <- f.desc }
+
+func (f failingCollector) Collect(ch chan<- prometheus.Metric) {
+	if f.panic {
+		panic("broken collector")
+	}
+	ch <- prometheus.NewInvalidMetric(f.desc, errors.New("broken collector"))
+}
+
+func TestStatsWithFailingCollector(t *testing.T) {
+	setupDB(t)
+	e := newTestServer(t)
+	for _, panics := range []bool{true, false} {
+		c := failingCollector{prometheus.NewDesc(fmt.Sprintf("failing_%v", panics), "Always fails", nil, nil), panics}
+		registerApp(c)
+		for _, target := range []string{"/stats", "/metrics/app"} {
+			rec := request(e, http.MethodGet, target, "")
+			if rec.Code != http.StatusInternalServerError {
+				t.Errorf("panic=%v %s: got %d, want 500", panics, target, rec.Code)
+			}
+		}
+		var resp errorResponse
+		decodeBody(t, request(e, http.MethodGet, "/stats", ""), &resp)
+		if resp.Code != "internal_server_error" || resp.Message == "" {
+			t.Errorf("panic=%v: got envelope %+v", panics, resp)
+		}
+		appRegistry.Unregister(c)
+	}
+	if rec := request(e, http.MethodGet, "/stats", ""); rec.Code != http.StatusOK {
+		t.Errorf("after unregistering: got %d, want 200", rec.Code)
+	}
+}
+
+func TestGzipExport(t *testing.T) {
+	setupDB(t)
+	e := newTestServer(t)
+	for _, title := range []string{"a", "b", "c"} {
+		createTestTodo(t, e, fmt.Sprintf(`{"title":%q}`, title))
+	}
+	rec := request(e, http.MethodGet, "/todos/export?format=ndjson&gzip=true", "")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("got %d %s", rec.Code, rec.Body)
+	}
+	if got := rec.Header().Get(echo.HeaderContentEncoding); got != "gzip" {
+		t.Errorf("Content-Encoding = %q, want gzip", got)
+	}
+	zr, err := gzip.NewReader(rec.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var titles []string
+	dec := json.NewDecoder(zr)
+	for dec.More() {
+		var todo TodoItem
+		if err := dec.Decode(&todo); err != nil {
+			t.Fatal(err)
+		}
+		titles = append(titles, todo.Title)
+	}
+	if !slices.Equal(titles, []string{"a", "b", "c"}) {
+		t.Errorf("decompressed titles %q, want [a b c]", titles)
+	}
+	if rec := request(e, http.MethodGet, "/todos/export?gzip=maybe", ""); rec.Code != http.StatusBadRequest {
+		t.Errorf("gzip=maybe: got %d, want 400", rec.Code)
+	}
+}
+
+// writeTestCert writes a self-signed ECDSA certificate for 127.0.0.1 and
+// returns the cert and key file paths.
+func writeTestCert(t *testing.T) (string, string) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600)
+	os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0o600)
+	return certFile, keyFile
+}
+
+func TestTLSSettings(t *testing.T) {
+	setupDB(t)
+	certFile, keyFile := writeTestCert(t)
+	t.Setenv("TLS_CERT_FILE", certFile)
+	t.Setenv("TLS_KEY_FILE", keyFile)
+
+	const allowed, other = tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256, tls.TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305_SHA256
+	tests := []struct {
+		name, minVersion, suites string
+		client                   *tls.Config
+		ok                       bool
+	}{
+		{"TLS 1.1 client", "1.2", "", &tls.Config{MinVersion: tls.VersionTLS10, MaxVersion: tls.VersionTLS11}, false},
+		{"TLS 1.2 client", "1.2", "", &tls.Config{MaxVersion: tls.VersionTLS12}, true},
+		{"TLS 1.2 client, 1.3 minimum", "1.3", "", &tls.Config{MaxVersion: tls.VersionTLS12}, false},
+		{"TLS 1.3 client, 1.3 minimum", "1.3", "", &tls.Config{}, true},
+		{"listed suite", "1.2", tls.CipherSuiteName(allowed),
+			&tls.Config{MaxVersion: tls.VersionTLS12, CipherSuites: []uint16{allowed}}, true},
+		{"unlisted suite", "1.2", tls.CipherSuiteName(allowed),
+			&tls.Config{MaxVersion: tls.VersionTLS12, CipherSuites: []uint16{other}}, false},
+	}
+	for _, tt := range tests {
+		t.Setenv("TLS_MIN_VERSION", tt.minVersion)
+		t.Setenv("TLS_CIPHER_SUITES", tt.suites)
+		e := newTestServer(t)
+		srv := httptest.NewUnstartedServer(e)
+		srv.TLS = e.Server.TLSConfig
+		srv.StartTLS()
+
+		tt.client.InsecureSkipVerify = true
+		conn, err := tls.Dial("tcp", srv.Listener.Addr().String(), tt.client)
+		if err == nil {
+			err = conn.Handshake()
+			conn.Close()
+		}
+		if (err == nil) != tt.ok {
+			t.Errorf("%s: handshake error %v, want success %v", tt.name, err, tt.ok)
+		}
+		srv.Close()
+	}
+
+	for _, bad := range []struct{ key, value string }{
+		{"TLS_MIN_VERSION", "1.1"},
+		{"TLS_CIPHER_SUITES", "TLS_RSA_WITH_RC4_128_SHA"},
+	} {
+		t.Setenv("TLS_MIN_VERSION", "1.2")
+		t.Setenv("TLS_CIPHER_SUITES", "")
+		t.Setenv(bad.key, bad.value)
+		if _, err := newServer(); err == nil {
+			t.Errorf("%s=%s: newServer succeeded", bad.key, bad.value)
+		}
+	}
+}
+
+func TestRecentTraces(t *testing.T) {
+	recorder := recordSpans(t)
+	setupDB(t)
+	setForTest(t, &recentTraces, newTraceRing(3))
+	t.Setenv("ADMIN_TOKEN", "secret")
+	e := newTestServer(t)
+	auth := []string{"Authorization", "Bearer secret"}
+
+	if rec := request(e, http.MethodGet, "/debug/recent-traces", ""); rec.Code != http.StatusUnauthorized {
+		t.Errorf("without token: got %d, want 401", rec.Code)
+	}
+	todo := createTestTodo(t, e, `{"title":"traced"}`)
+	request(e, http.MethodDelete, fmt.Sprintf("/todos/%d", todo.ID), "")
+	request(e, http.MethodPost, "/todos/99/pin", "")
+	rec := request(e, http.MethodGet, "/debug/recent-traces", "", auth...)
+	var got []recentTrace
+	decodeBody(t, rec, &got)
+
+	// The ring holds three entries, newest first; the 401 was evicted.
+	want := []struct {
+		method, route string
+		status        int
+	}{
+		{http.MethodPost, "/todos/:id/pin", http.StatusNotFound},
+		{http.MethodDelete, "/todos/:id", http.StatusNoContent},
+		{http.MethodPost, "/todos", http.StatusCreated},
+	}
+	if len(got) != len(want) {
+		t.Fatalf("got %d entries %+v, want %d", len(got), got, len(want))
+	}
+	traceIDs := make(map[string]bool)
+	for _, span := range recorder.Ended() {
+		traceIDs[span.SpanContext().TraceID().String()] = true
+	}
+	for i, w := range want {
+		if got[i].Method != w.method || got[i].Route != w.route || got[i].Status != w.status {
+			t.Errorf("entry %d = %+v, want %s %s %d", i, got[i], w.method, w.route, w.status)
+		}
+		if !traceIDs[got[i].TraceID] {
+			t.Errorf("entry %d trace id %s was not recorded", i, got[i].TraceID)
+		}
+	}
+}
+
+func TestTrailingSlashPolicy(t *testing.T) {
+	setupDB(t)
+	tests := []struct {
+		policy   string
+		status   int
+		location string
+	}{
+		{"", http.StatusOK, ""},
+		{"remove", http.StatusOK, ""},
+		{"redirect", http.StatusMovedPermanently, "/todos?limit=5"},
+		{"off", http.StatusNotFound, ""},
+	}
+	for _, tt := range tests {
+		t.Setenv("TRAILING_SLASH", tt.policy)
+		e := newTestServer(t)
+		plain := request(e, http.MethodGet, "/todos?limit=5", "")
+		rec := request(e, http.MethodGet, "/todos/?limit=5", "")
+		if rec.Code != tt.status {
+			t.Errorf("TRAILING_SLASH=%q: got %d, want %d", tt.policy, rec.Code, tt.status)
+		}
+		if got := rec.Header().Get(echo.HeaderLocation); got != tt.location {
+			t.Errorf("TRAILING_SLASH=%q: Location %q, want %q", tt.policy, got, tt.location)
+		}
+		if tt.status == http.StatusOK && rec.Body.String() != plain.Body.String() {
+			t.Errorf("TRAILING_SLASH=%q: /todos/ body %s differs from /todos %s", tt.policy, rec.Body, plain.Body)
+		}
+	}
+	t.Setenv("TRAILING_SLASH", "add")
+	if _, err := newServer(); err == nil {
+		t.Error("TRAILING_SLASH=add: newServer succeeded")
+	}
+}
+
+func TestEncodeErrors(t *testing.T) {
+	setupDB(t)
+	for _, fieldCase := range []string{"snake", "camel"} {
+		t.Setenv("JSON_FIELD_CASE", fieldCase)
+		e := newTestServer(t)
+		rec := httptest.NewRecorder()
+		c := e.NewContext(httptest.NewRequest(http.MethodGet, "/stats", nil), rec)
+		before := testutil.ToFloat64(encodeErrors)
+
+		err := writeJSON(c, http.StatusOK, map[string]float64{"bad": math.Inf(1)})
+		if err == nil {
+			t.Fatalf("%s: encoding +Inf succeeded", fieldCase)
+		}
+		if got := testutil.ToFloat64(encodeErrors) - before; got != 1 {
+			t.Errorf("%s: encode errors += %v, want 1", fieldCase, got)
+		}
+		e.HTTPErrorHandler(err, c)
+		var resp errorResponse
+		decodeBody(t, rec, &resp)
+		if rec.Code != http.StatusInternalServerError || resp.Code != "internal_server_error" {
+			t.Errorf("%s: got %d %+v, want a 500 envelope", fieldCase, rec.Code, resp)
+		}
+	}
+}
+
+func TestExportRange(t *testing.T) {
+	setupDB(t)
+	e := newTestServer(t)
+	createTestTodo(t, e, `{"title":"a"}`)
+	createTestTodo(t, e, `{"title":"b"}`)
+	full := request(e, http.MethodGet, "/todos/export?format=csv", "").Body.String()
+
+	rec := request(e, http.MethodGet, "/todos/export?format=csv", "", "Range", "bytes=3-12")
+	if rec.Code != http.StatusPartialContent {
+		t.Fatalf("got %d, want 206", rec.Code)
+	}
+	if got := rec.Body.String(); got != full[3:13] {
+		t.Errorf("range body %q, want %q", got, full[3:13])
+	}
+	if got, want := rec.Header().Get("Content-Range"), fmt.Sprintf("bytes 3-12/%d", len(full)); got != want {
+		t.Errorf("Content-Range = %q, want %q", got, want)
+	}
+	etag := rec.Header().Get("ETag")
+
+	// If-Range with the current ETag resumes; a stale one gets the full body.
+	tests := []struct {
+		ifRange string
+		want    int
+	}{
+		{etag, http.StatusPartialContent},
+		{`"stale"`, http.StatusOK},
+	}
+	for _, tt := range tests {
+		rec := request(e, http.MethodGet, "/todos/export?format=csv", "", "Range", "bytes=3-12", "If-Range", tt.ifRange)
+		if rec.Code != tt.want {
+			t.Errorf("If-Range %s: got %d, want %d", tt.ifRange, rec.Code, tt.want)
+		}
+	}
+}
+
+func TestCORSOriginsFile(t *testing.T) {
+	setupDB(t)
+	file := filepath.Join(t.TempDir(), "origins")
+	if err := os.WriteFile(file, []byte("# trusted frontends\nhttps://a.example\n\n  https://b.example  \n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("CORS_ORIGINS", "https://env.example")
+	t.Setenv("CORS_ORIGINS_FILE", file)
+	// A handled SIGHUP cannot kill the test binary before the reloader's
+	// signal.Notify runs.
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	t.Cleanup(func() { signal.Stop(hup) })
+	e := newTestServer(t)
+
+	allowed := func(origin string) bool {
+		rec := request(e, http.MethodGet, "/todos", "", echo.HeaderOrigin, origin)
+		return rec.Header().Get(echo.HeaderAccessControlAllowOrigin) == origin
+	}
+	for origin, want := range map[string]bool{
+		"https://a.example":   true,
+		"https://b.example":   true,
+		"https://env.example": true,
+		"https://c.example":   false,
+	} {
+		if got := allowed(origin); got != want {
+			t.Errorf("%s allowed = %v, want %v", origin, got, want)
+		}
+	}
+
+	if err := os.WriteFile(file, []byte("https://c.example\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(3 * time.Second)
+	for !allowed("https://c.example") {
+		if time.Now().After(deadline) {
+			t.Fatal("origins were not reloaded on SIGHUP")
+		}
+		syscall.Kill(os.Getpid(), syscall.SIGHUP)
+		time.Sleep(20 * time.Millisecond)
+	}
+	if allowed("https://a.example") {
+		t.Error("origin removed from the file is still allowed")
+	}
+	if !allowed("https://env.example") {
+		t.Error("CORS_ORIGINS entry lost on reload")
+	}
+}
+
+func TestPoolExhaustion(t *testing.T) {
+	t.Setenv("DB_MAX_OPEN_CONNS", "1")
+	t.Setenv("REQUEST_TIMEOUT", "100ms")
+	setupDB(t)
+	e := newTestServer(t)
+
+	conn, err := db.Conn(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	before := testutil.ToFloat64(dbPoolExhausted)
+	rec := request(e, http.MethodGet, "/todos", "")
+	conn.Close()
+
+	var resp errorResponse
+	decodeBody(t, rec, &resp)
+	if rec.Code != http.StatusServiceUnavailable || resp.Message != "service busy, retry later" {
+		t.Errorf("saturated pool: got %d %+v, want a 503 busy envelope", rec.Code, resp)
+	}
+	if got := testutil.ToFloat64(dbPoolExhausted) - before; got != 1 {
+		t.Errorf("db_pool_exhausted_total += %v, want 1", got)
+	}
+	if rec := request(e, http.MethodGet, "/todos", ""); rec.Code != http.StatusOK {
+		t.Errorf("after release: got %d, want 200", rec.Code)
+	}
+}
+
+func TestLongPollWithinRequestTimeout(t *testing.T) {
+	t.Setenv("REQUEST_TIMEOUT", "200ms")
+	setupDB(t)
+	e := newTestServer(t)
+	createTestTodo(t, e, `{"title":"unchanged"}`)
+
+	start := time.Now()
+	rec := request(e, http.MethodGet, "/todos?wait=2s", "")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("got %d %s, want 200", rec.Code, rec.Body)
+	}
+	if elapsed := time.Since(start); elapsed >= 200*time.Millisecond {
+		t.Errorf("poll took %s, past the request timeout", elapsed)
+	}
+	var todos []TodoItem
+	decodeBody(t, rec, &todos)
+	if got := todoTitles(todos); !slices.Equal(got, []string{"unchanged"}) {
+		t.Errorf("poll returned %q", got)
+	}
+}
+
+func TestExplainListQuery(t *testing.T) {
+	t.Setenv("ADMIN_TOKEN", "secret")
+	auth := []string{"Authorization", "Bearer secret"}
+	tests := []struct {
+		unique bool
+		query  string
+		want   string
+	}{
+		{true, "?sort=title", "USING INDEX idx_todos_title"},
+		{true, "?completed=true&sort=title", "USING INDEX idx_todos_title"},
+		{false, "?sort=title", "USE TEMP B-TREE FOR ORDER BY"},
+		{false, "?sort=id", "SCAN todos"},
+	}
+	for _, tt := range tests {
+		setForTest(t, &uniqueTitles, tt.unique)
+		setupDB(t)
+		e := newTestServer(t)
+		rec := request(e, http.MethodGet, "/debug/explain"+tt.query, "", auth...)
+		var resp struct {
+			Query string         `json:"query"`
+			Plan  []queryPlanRow `json:"plan"`
+		}
+		decodeBody(t, rec, &resp)
+		if rec.Code != http.StatusOK || len(resp.Plan) == 0 {
+			t.Fatalf("%s: got %d %s", tt.query, rec.Code, rec.Body)
+		}
+		found := false
+		for _, row := range resp.Plan {
+			found = found || strings.Contains(row.Detail, tt.want)
+		}
+		if !found {
+			t.Errorf("unique=%v %s: plan %+v does not mention %q", tt.unique, tt.query, resp.Plan, tt.want)
+		}
+	}
+	for _, bad := range []string{"?sort=rank", "?completed=maybe"} {
+		if rec := request(newTestServer(t), http.MethodGet, "/debug/explain"+bad, "", auth...); rec.Code != http.StatusBadRequest {
+			t.Errorf("%s: got %d, want 400", bad, rec.Code)
+		}
+	}
+}
+
+func TestJSONAPIList(t *testing.T) {
+	setupDB(t)
+	e := newTestServer(t)
+	todo := createTestTodo(t, e, `{"title":"spec"}`)
+
+	rec := request(e, http.MethodGet, "/todos", "", echo.HeaderAccept, "text/html, application/vnd.api+json")
+	if got := rec.Header().Get(echo.HeaderContentType); got != "application/vnd.api+json" {
+		t.Errorf("Content-Type = %q, want application/vnd.api+json", got)
+	}
+	var doc struct {
+		Data []struct {
+			Type       string          `json:"type"`
+			ID         string          `json:"id"`
+			Attributes json.RawMessage `json:"attributes"`
+		} `json:"data"`
+	}
+	decodeBody(t, rec, &doc)
+	if len(doc.Data) != 1 || doc.Data[0].Type != "todos" || doc.Data[0].ID != strconv.Itoa(todo.ID) {
+		t.Fatalf("JSON:API document %+v", doc)
+	}
+	var attrs map[string]interface{}
+	if err := json.Unmarshal(doc.Data[0].Attributes, &attrs); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := attrs["id"]; ok || attrs["title"] != "spec" {
+		t.Errorf("attributes %v, want the title and no id", attrs)
+	}
+
+	for _, accept := range []string{"", echo.MIMEApplicationJSON} {
+		var todos []TodoItem
+		decodeBody(t, request(e, http.MethodGet, "/todos", "", echo.HeaderAccept, accept), &todos)
+		if got := todoTitles(todos); !slices.Equal(got, []string{"spec"}) {
+			t.Errorf("Accept %q: plain list %q", accept, got)
+		}
+	}
+}
+
+func TestRotateDB(t *testing.T) {
+	setupDB(t)
+	t.Setenv("ADMIN_TOKEN", "secret")
+	e := newTestServer(t)
+	auth := []string{"Authorization", "Bearer secret"}
+	createTestTodo(t, e, `{"title":"archived"}`)
+	archive := filepath.Join(t.TempDir(), "archive.db")
+
+	if rec := request(e, http.MethodPost, "/admin/rotate", "", auth...); rec.Code != http.StatusBadRequest {
+		t.Errorf("without archive_path: got %d, want 400", rec.Code)
+	}
+	rec := request(e, http.MethodPost, "/admin/rotate?archive_path="+url.QueryEscape(archive), "", auth...)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("rotate: got %d %s", rec.Code, rec.Body)
+	}
+	var todos []TodoItem
+	decodeBody(t, request(e, http.MethodGet, "/todos", ""), &todos)
+	if len(todos) != 0 {
+		t.Errorf("todos after rotating: %q, want none", todoTitles(todos))
+	}
+	createTestTodo(t, e, `{"title":"fresh"}`)
+
+	archived, err := sql.Open("sqlite3", archive)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer archived.Close()
+	var title string
+	if err := archived.QueryRow("SELECT title FROM todos").Scan(&title); err != nil || title != "archived" {
+		t.Errorf("archive holds %q (%v), want archived", title, err)
+	}
+
+	// An existing archive is never overwritten.
+	rec = request(e, http.MethodPost, "/admin/rotate?archive_path="+url.QueryEscape(archive), "", auth...)
+	if rec.Code != http.StatusConflict {
+		t.Errorf("existing archive: got %d, want 409", rec.Code)
+	}
+	decodeBody(t, request(e, http.MethodGet, "/todos", ""), &todos)
+	if got := todoTitles(todos); !slices.Equal(got, []string{"fresh"}) {
+		t.Errorf("todos after a refused rotation: %q, want [fresh]", got)
+	}
+
+	// A fresh database that fails to open keeps the old one serving.
+	t.Setenv("DB_MAX_OPEN_CONNS", "bogus")
+	failed := filepath.Join(t.TempDir(), "failed.db")
+	rec = request(e, http.MethodPost, "/admin/rotate?archive_path="+url.QueryEscape(failed), "", auth...)
+	if rec.Code != http.StatusInternalServerError {
+		t.Errorf("failed initDB: got %d, want 500", rec.Code)
+	}
+	if _, err := os.Stat(failed); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("archive left behind after a failed rotation (stat: %v)", err)
+	}
+	decodeBody(t, request(e, http.MethodGet, "/todos", ""), &todos)
+	if got := todoTitles(todos); !slices.Equal(got, []string{"fresh"}) {
+		t.Errorf("todos after a failed rotation: %q, want [fresh]", got)
+	}
+	createTestTodo(t, e, `{"title":"still writable"}`)
+}
+
+func TestRequestLogSampling(t *testing.T) {
+	setupDB(t)
+	tests := []struct {
+		rate     string
+		min, max int
+	}{
+		{"1", 400, 400},
+		{"0.25", 60, 140},
+		{"0", 0, 0},
+	}
+	for _, tt := range tests {
+		t.Setenv("LOG_SAMPLE_RATE", tt.rate)
+		e := newTestServer(t)
+		e.GET("/test/fail", func(c echo.Context) error {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed")
+		})
+		var buf bytes.Buffer
+		e.Logger.SetOutput(&buf)
+
+		for i := 0; i < 400; i++ {
+			request(e, http.MethodGet, "/time", "")
+		}
+		if got := strings.Count(buf.String(), "\n"); got < tt.min || got > tt.max {
+			t.Errorf("LOG_SAMPLE_RATE=%s: logged %d of 400 successful requests, want %d-%d", tt.rate, got, tt.min, tt.max)
+		}
+		buf.Reset()
+		for i := 0; i < 50; i++ {
+			request(e, http.MethodGet, "/test/fail", "")
+		}
+		if got := strings.Count(buf.String(), `"status":500`); got != 50 {
+			t.Errorf("LOG_SAMPLE_RATE=%s: logged %d of 50 failed requests, want all", tt.rate, got)
+		}
+	}
+}
+
+func TestResponseCache(t *testing.T) {
+	rc := newResponseCache(2, time.Minute)
+	rc.put("a", 1, "A")
+	rc.put("b", 1, "B")
+	if got := testutil.ToFloat64(listCacheEntries); got != 2 {
+		t.Errorf("cache size gauge = %v, want 2", got)
+	}
+	// Reading a makes b the least recently used, so c evicts b.
+	if v, ok := rc.get("a", 1); !ok || v != "A" {
+		t.Fatalf("get a = %v %v", v, ok)
+	}
+	rc.put("c", 1, "C")
+	for key, want := range map[string]bool{"a": true, "b": false, "c": true} {
+		if _, ok := rc.get(key, 1); ok != want {
+			t.Errorf("after eviction, %s cached = %v, want %v", key, ok, want)
+		}
+	}
+
+	// A stale read is not cached and a newer version drops everything.
+	rc.put("d", 0, "D")
+	if _, ok := rc.get("d", 1); ok {
+		t.Error("response read before the latest mutation was cached")
+	}
+	if _, ok := rc.get("a", 2); ok {
+		t.Error("entry survived a mutation")
+	}
+	if got := testutil.ToFloat64(listCacheEntries); got != 0 {
+		t.Errorf("cache size gauge = %v after invalidation, want 0", got)
+	}
+
+	expiring := newResponseCache(2, time.Millisecond)
+	expiring.put("a", 0, "A")
+	time.Sleep(5 * time.Millisecond)
+	if _, ok := expiring.get("a", 0); ok {
+		t.Error("entry served past its TTL")
+	}
+
+	var disabled *responseCache
+	disabled.put("a", 0, "A")
+	if _, ok := disabled.get("a", 0); ok {
+		t.Error("nil cache hit")
+	}
+}
+
+func TestListCacheKeys(t *testing.T) {
+	setupDB(t)
+	setForTest(t, &listCache, newResponseCache(10, time.Minute))
+	setForTest(t, &enabledFeatures, map[string]bool{"board": true})
+	e := newTestServer(t)
+	createTestTodo(t, e, `{"title":"a"}`)
+
+	for _, target := range []string{"/todos", "/todos/board?limit=1", "/todos/board?limit=2", "/todos/board?limit=1"} {
+		if rec := request(e, http.MethodGet, target, ""); rec.Code != http.StatusOK {
+			t.Fatalf("%s: got %d", target, rec.Code)
+		}
+	}
+	if got := testutil.ToFloat64(listCacheEntries); got != 3 {
+		t.Errorf("%v cache entries, want one per distinct query (3)", got)
+	}
+	createTestTodo(t, e, `{"title":"b"}`)
+	var todos []TodoItem
+	decodeBody(t, request(e, http.MethodGet, "/todos", ""), &todos)
+	if got := todoTitles(todos); !slices.Equal(got, []string{"a", "b"}) {
+		t.Errorf("list after a create = %q, want [a b]", got)
+	}
+	if got := testutil.ToFloat64(listCacheEntries); got != 1 {
+		t.Errorf("%v cache entries after a create, want 1", got)
+	}
+}
+
+func TestTitleNormalization(t *testing.T) {
+	tests := []struct {
+		normalize, lowercase bool
+		title, want          string
+	}{
+		{false, false, "  Buy   Milk ", "  Buy   Milk "},
+		{true, false, "  Buy   Milk ", "Buy Milk"},
+		{true, true, "  Buy \t Milk ", "buy milk"},
+		{false, true, "Buy Milk", "Buy Milk"}, // lowercasing is part of normalizing
+	}
+	setForTest(t, &uniqueTitles, true)
+	for _, tt := range tests {
+		setForTest(t, &normalizeTitles, tt.normalize)
+		setForTest(t, &lowercaseTitles, tt.lowercase)
+		setupDB(t)
+		e := newTestServer(t)
+		body, _ := json.Marshal(map[string]string{"title": tt.title})
+		if got := createTestTodo(t, e, string(body)).Title; got != tt.want {
+			t.Errorf("normalize=%v lowercase=%v: created %q, want %q", tt.normalize, tt.lowercase, got, tt.want)
+		}
+		upserted := request(e, http.MethodPut, "/todos?by=title", string(body))
+		var todo TodoItem
+		decodeBody(t, upserted, &todo)
+		if todo.Title != tt.want || todo.ID != 1 {
+			t.Errorf("normalize=%v lowercase=%v: upsert gave %d %+v, want todo 1 titled %q",
+				tt.normalize, tt.lowercase, upserted.Code, todo, tt.want)
+		}
+	}
+
+	// With unique titles, titles that normalize alike conflict.
+	setForTest(t, &normalizeTitles, true)
+	setForTest(t, &lowercaseTitles, true)
+	setForTest(t, &uniqueTitles, true)
+	setupDB(t)
+	e := newTestServer(t)
+	createTestTodo(t, e, `{"title":"Buy Milk"}`)
+	if rec := request(e, http.MethodPost, "/todos", `{"title":"buy  milk "}`); rec.Code != http.StatusConflict {
+		t.Errorf("normalized duplicate: got %d, want 409", rec.Code)
+	}
+}
+
+type failingExporter struct {
+	sdktrace.SpanExporter
+}
+
+func (failingExporter) ExportSpans(context.Context, []sdktrace.ReadOnlySpan) error {
+	return errors.New("collector down")
+}
+
+func TestTraceLastExportGauge(t *testing.T) {
+	tests := []struct {
+		name     string
+		exporter sdktrace.SpanExporter
+		advances bool
+	}{
+		{"failing", failingExporter{tracetest.NewInMemoryExporter()}, false},
+		{"succeeding", tracetest.NewInMemoryExporter(), true},
+	}
+	for _, tt := range tests {
+		traceLastExport.Set(0)
+		start := float64(time.Now().Unix())
+		tp := sdktrace.NewTracerProvider(sdktrace.WithSyncer(exportTimestamper{tt.exporter}))
+		_, span := tp.Tracer("test").Start(context.Background(), "exported")
+		span.End()
+		tp.Shutdown(context.Background())
+
+		got := testutil.ToFloat64(traceLastExport)
+		if tt.advances && got < start || !tt.advances && got != 0 {
+			t.Errorf("%s exporter: trace_last_export_success_timestamp_seconds = %v", tt.name, got)
+		}
+	}
+}
+
+func TestFeatureHeaderOverride(t *testing.T) {
+	setupDB(t)
+	setForTest(t, &enabledFeatures, map[string]bool{})
+	e := newTestServer(t)
+	tests := []struct {
+		allow  bool
+		header string
+		want   int
+	}{
+		{false, "board", http.StatusNotFound},
+		{true, "", http.StatusNotFound},
+		{true, "other", http.StatusNotFound},
+		{true, "board", http.StatusOK},
+		{true, "other, board", http.StatusOK},
+	}
+	for _, tt := range tests {
+		setForTest(t, &allowFeatureHeader, tt.allow)
+		if rec := request(e, http.MethodGet, "/todos/board", "", "X-Enable-Feature", tt.header); rec.Code != tt.want {
+			t.Errorf("ALLOW_FEATURE_HEADER=%v X-Enable-Feature=%q: got %d, want %d", tt.allow, tt.header, rec.Code, tt.want)
+		}
+	}
+}
+
+func TestSlowQueryLog(t *testing.T) {
+	setupDB(t)
+	e := newTestServer(t)
+	var logs bytes.Buffer
+	log.SetOutput(&logs)
+	t.Cleanup(func() { log.SetOutput(os.Stderr) })
+	slow := dbSlowQueries.WithLabelValues("SELECT")
+
+	tests := []struct {
+		threshold time.Duration
+		slow      bool
+	}{
+		{0, false}, // disabled
+		{time.Hour, false},
+		{time.Nanosecond, true},
+	}
+	for _, tt := range tests {
+		setForTest(t, &slowQueryThreshold, tt.threshold)
+		logs.Reset()
+		before := testutil.ToFloat64(slow)
+		request(e, http.MethodGet, "/todos", "")
+
+		counted := testutil.ToFloat64(slow) - before
+		logged := strings.Contains(logs.String(), "WARN slow SELECT query took ")
+		if (counted == 1) != tt.slow || logged != tt.slow {
+			t.Errorf("threshold %s: counted %v, logged %v (%q), want slow=%v", tt.threshold, counted, logged, logs.String(), tt.slow)
+		}
+		if tt.slow && !strings.Contains(logs.String(), "FROM todos ORDER BY pinned DESC, id") {
+			t.Errorf("slow query log %q does not include the statement", logs.String())
+		}
+	}
+}
+
+func TestAbsentDescriptionIsNull(t *testing.T) {
+	setupDB(t)
+	e := newTestServer(t)
+	tests := []struct {
+		body    string
+		null    bool
+		jsonKey bool
+	}{
+		{`{"title":"absent"}`, true, false},
+		{`{"title":"null","description":null}`, true, false},
+		{`{"title":"empty","description":""}`, false, true},
+		{`{"title":"set","description":"x"}`, false, true},
+	}
+	for _, tt := range tests {
+		todo := createTestTodo(t, e, tt.body)
+		var description sql.NullString
+		if err := db.QueryRow("SELECT description FROM todos WHERE id = ?", todo.ID).Scan(&description); err != nil {
+			t.Fatal(err)
+		}
+		if description.Valid == tt.null {
+			t.Errorf("%s: stored %+v, want NULL %v", tt.body, description, tt.null)
+		}
+	}
+
+	rec := request(e, http.MethodGet, "/todos/export?format=ndjson", "")
+	lines := strings.Split(strings.TrimSpace(rec.Body.String()), "\n")
+	if len(lines) != len(tests) {
+		t.Fatalf("export has %d lines, want %d", len(lines), len(tests))
+	}
+	for i, tt := range tests {
+		var fields map[string]json.RawMessage
+		if err := json.Unmarshal([]byte(lines[i]), &fields); err != nil {
+			t.Fatal(err)
+		}
+		if _, ok := fields["description"]; ok != tt.jsonKey {
+			t.Errorf("%s: exported %s, want description present %v", tt.body, lines[i], tt.jsonKey)
+		}
+	}
+}
+
+func TestHistogramDisabledRoutes(t *testing.T) {
+	setupDB(t)
+	t.Setenv("HISTOGRAM_DISABLED_ROUTES", "/todos,/metrics")
+	e := newTestServer(t)
+	// The metrics endpoints count into promhttp's own handler counter.
+	scrapeCount := func() float64 {
+		families, _ := prometheus.DefaultGatherer.Gather()
+		for _, mf := range families {
+			if mf.GetName() == "promhttp_metric_handler_requests_total" {
+				for _, m := range mf.GetMetric() {
+					if m.GetLabel()[0].GetValue() == "200" {
+						return m.GetCounter().GetValue()
+					}
+				}
+			}
+		}
+		return 0
+	}
+
+	tests := []struct {
+		target    string
+		histogram bool
+		counted   func() float64
+	}{
+		{"/todos", false, func() float64 { return testutil.ToFloat64(requestCount.WithLabelValues(http.MethodGet, "/todos")) }},
+		{"/todos/export", true, func() float64 {
+			return testutil.ToFloat64(requestCount.WithLabelValues(http.MethodGet, "/todos/export"))
+		}},
+		{"/metrics", false, scrapeCount},
+	}
+	for _, tt := range tests {
+		observer := requestDuration.WithLabelValues(http.MethodGet, tt.target)
+		samples, count := histogramCount(t, observer), tt.counted()
+		if rec := request(e, http.MethodGet, tt.target, ""); rec.Code != http.StatusOK {
+			t.Fatalf("%s: got %d", tt.target, rec.Code)
+		}
+		if got := histogramCount(t, observer) - samples; (got == 1) != tt.histogram {
+			t.Errorf("%s: %d histogram samples, want histogram %v", tt.target, got, tt.histogram)
+		}
+		if got := tt.counted() - count; got != 1 {
+			t.Errorf("%s: request counter += %v, want 1", tt.target, got)
+		}
+	}
+}
+
+func TestListCountHeaders(t *testing.T) {
+	setupDB(t)
+	e := newTestServer(t)
+	for _, body := range []string{
+		`{"title":"a"}`, `{"title":"b","status":"in_progress"}`, `{"title":"c","completed":true}`, `{"title":"d","status":"done"}`,
+	} {
+		createTestTodo(t, e, body)
+	}
+	want := map[string]string{"X-Total-Count": "4", "X-Completed-Count": "2", "X-Pending-Count": "2"}
+	for _, method := range []string{http.MethodGet, http.MethodHead} {
+		rec := request(e, method, "/todos", "")
+		for header, value := range want {
+			if got := rec.Header().Get(header); got != value {
+				t.Errorf("%s /todos: %s = %q, want %s", method, header, got, value)
+			}
+		}
+	}
+}
+
+func TestDegradedDBRejectsWrites(t *testing.T) {
+	setupDB(t)
+	t.Cleanup(func() { dbDegraded.Store(false) })
+	t.Setenv("ADMIN_TOKEN", "secret")
+	t.Setenv("READY_DB_DEGRADED_THRESHOLD", "1ns")
+	e := newTestServer(t)
+	auth := []string{"Authorization", "Bearer secret"}
+
+	rec := request(e, http.MethodGet, "/readyz", "")
+	var ready struct {
+		Status string `json:"status"`
+	}
+	decodeBody(t, rec, &ready)
+	if rec.Code != http.StatusOK || ready.Status != "degraded" || !dbDegraded.Load() {
+		t.Fatalf("slow ping: got %d %s, degraded %v", rec.Code, rec.Body, dbDegraded.Load())
+	}
+
+	var resp errorResponse
+	rec = request(e, http.MethodPost, "/todos", `{"title":"blocked"}`)
+	decodeBody(t, rec, &resp)
+	if rec.Code != http.StatusServiceUnavailable || !strings.Contains(resp.Message, "degraded") {
+		t.Errorf("write while degraded: got %d %+v, want 503", rec.Code, resp)
+	}
+	if rec := request(e, http.MethodGet, "/todos", ""); rec.Code != http.StatusOK {
+		t.Errorf("read while degraded: got %d, want 200", rec.Code)
+	}
+	if rec := request(e, http.MethodPost, "/admin/refresh-gauges", "", auth...); rec.Code != http.StatusNoContent {
+		t.Errorf("admin write while degraded: got %d, want 204", rec.Code)
+	}
+
+	t.Setenv("READY_DB_DEGRADED_THRESHOLD", "1h")
+	e = newTestServer(t)
+	request(e, http.MethodGet, "/readyz", "")
+	if dbDegraded.Load() {
+		t.Fatal("a fast ping did not clear the degraded state")
+	}
+	createTestTodo(t, e, `{"title":"accepted"}`)
+}
+
+type camelEmbedded struct {
+	EmbeddedField string `json:"embedded_field"`
+}
+
+type camelSample struct {
+	camelEmbedded
+	TraceID   string             `json:"trace_id"`
+	Skipped   string             `json:"-"`
+	Omitted   string             `json:"omitted_field,omitempty"`
+	Stats     map[string]float64 `json:"metric_stats"`
+	Nested    []queryPlanRow     `json:"nested_rows"`
+	NilSlice  []string           `json:"nil_slice"`
+	CreatedAt time.Time          `json:"created_at"`
+	Untagged  int
+	private   int
+}
+
+func TestCamelCaseValue(t *testing.T) {
+	at := time.Date(2026, 10, 14, 9, 0, 0, 0, time.UTC)
+	v := camelSample{
+		camelEmbedded: camelEmbedded{"e"},
+		TraceID:       "abc",
+		Skipped:       "x",
+		Stats:         map[string]float64{"http_request_count": 2},
+		Nested:        []queryPlanRow{{ID: 1, Detail: "SCAN todos"}},
+		CreatedAt:     at,
+		Untagged:      3,
+		private:       4,
+	}
+	b, err := json.Marshal(camelCaseValue(reflect.ValueOf(v)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `{"embeddedField":"e","traceId":"abc","metricStats":{"http_request_count":2},` +
+		`"nestedRows":[{"id":1,"parent":0,"detail":"SCAN todos"}],"nilSlice":null,` +
+		`"createdAt":"2026-10-14T09:00:00Z","Untagged":3}`
+	if string(b) != want {
+		t.Errorf("got  %s\nwant %s", b, want)
+	}
+}
+
+func TestCamelToSnake(t *testing.T) {
+	tests := []struct{ in, want string }{
+		{"title", "title"},
+		{"traceId", "trace_id"},
+		{"createdAt", "created_at"},
+		{"ID", "id"},
+		{"traceID", "trace_id"},
+		{"HTTPStatus", "http_status"},
+		{"createdAtUTC", "created_at_utc"},
+		{"userIDHash", "user_id_hash"},
+		{"snake_case", "snake_case"},
+	}
+	for _, tt := range tests {
+		if got := camelToSnake(tt.in); got != tt.want {
+			t.Errorf("camelToSnake(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestJSONFieldCase(t *testing.T) {
+	setupDB(t)
+	tests := []struct {
+		fieldCase string
+		fields    []string
+		todoField string
+	}{
+		{"snake", []string{"status", "db_ping"}, "trace_id"},
+		{"camel", []string{"status", "dbPing"}, "traceId"},
+	}
+	for _, tt := range tests {
+		t.Setenv("JSON_FIELD_CASE", tt.fieldCase)
+		e := newTestServer(t)
+
+		var ready map[string]string
+		decodeBody(t, request(e, http.MethodGet, "/readyz", ""), &ready)
+		if got := slices.Sorted(maps.Keys(ready)); !slices.Equal(got, slices.Sorted(slices.Values(tt.fields))) {
+			t.Errorf("%s: /readyz fields %q, want %q", tt.fieldCase, got, tt.fields)
+		}
+		if ready["status"] != "ok" {
+			t.Errorf("%s: /readyz status %q, want ok", tt.fieldCase, ready["status"])
+		}
+
+		var envelope map[string]interface{}
+		decodeBody(t, request(e, http.MethodGet, "/nope", ""), &envelope)
+		if _, ok := envelope[tt.todoField]; !ok || envelope["code"] != "not_found" {
+			t.Errorf("%s: error envelope %v, want code not_found and %s", tt.fieldCase, envelope, tt.todoField)
+		}
+
+		// Map keys are data and keep their names.
+		var stats map[string]float64
+		decodeBody(t, request(e, http.MethodGet, "/stats", ""), &stats)
+		for _, name := range statsMetrics {
+			if _, ok := stats[name]; !ok {
+				t.Errorf("%s: /stats lost %s: %v", tt.fieldCase, name, stats)
+			}
+		}
+
+		// Request bodies are accepted in the same case and values survive.
+		todo := createTestTodo(t, e, `{"title":"cased","description":"d","status":"in_progress"}`)
+		if todo.Title != "cased" || todo.Description == nil || *todo.Description != "d" || todo.Status != "in_progress" {
+			t.Errorf("%s: created %+v", tt.fieldCase, todo)
+		}
+	}
+	t.Setenv("JSON_FIELD_CASE", "kebab")
+	if _, err := newServer(); err == nil {
+		t.Error("JSON_FIELD_CASE=kebab: newServer succeeded")
+	}
+}
+
+func TestExportFieldCase(t *testing.T) {
+	for _, tt := range []struct {
+		camel bool
+		want  string
+	}{{false, "query_plan"}, {true, "queryPlan"}} {
+		setForTest(t, &camelCaseFields, tt.camel)
+		var buf bytes.Buffer
+		json.NewEncoder(&buf).Encode(jsonFields(struct {
+			QueryPlan []queryPlanRow `json:"query_plan"`
+		}{}))
+		if !strings.Contains(buf.String(), `"`+tt.want+`"`) {
+			t.Errorf("camel=%v: encoded %s, want field %s", tt.camel, buf.String(), tt.want)
+		}
+	}
+}
+
+func TestURLLengthLimit(t *testing.T) {
+	setupDB(t)
+	t.Setenv("HTTP_MAX_URL_LENGTH", "64")
+	e := newTestServer(t)
+	tests := []struct {
+		target string
+		want   int
+	}{
+		{"/todos?limit=5", http.StatusOK},
+		{"/todos?ids=" + strings.Repeat("1,", 40), http.StatusRequestURITooLong},
+		{"/nope/" + strings.Repeat("a", 64), http.StatusRequestURITooLong},
+	}
+	for _, tt := range tests {
+		rec := request(e, http.MethodGet, tt.target, "")
+		if rec.Code != tt.want {
+			t.Errorf("%d-byte URI: got %d, want %d", len(tt.target), rec.Code, tt.want)
+		}
+	}
+	var resp errorResponse
+	decodeBody(t, request(e, http.MethodGet, tests[1].target, ""), &resp)
+	if resp.Code != "request_uri_too_long" {
+		t.Errorf("envelope code %q, want request_uri_too_long", resp.Code)
+	}
+}
+
+func TestReadOnlyMode(t *testing.T) {
+	setupDB(t)
+	t.Cleanup(func() { readOnly.Store(false) })
+	t.Setenv("ADMIN_TOKEN", "secret")
+	e := newTestServer(t)
+	auth := []string{"Authorization", "Bearer secret"}
+	todo := createTestTodo(t, e, `{"title":"kept"}`)
+
+	rec := request(e, http.MethodPost, "/admin/read-only?enabled=true", "", auth...)
+	var toggled map[string]bool
+	decodeBody(t, rec, &toggled)
+	if rec.Code != http.StatusOK || !toggled["read_only"] {
+		t.Fatalf("enable read-only: got %d %s", rec.Code, rec.Body)
+	}
+	writes := []struct{ method, target, body string }{
+		{http.MethodPost, "/todos", `{"title":"new"}`},
+		{http.MethodPut, "/todos?by=title", `{"title":"kept"}`},
+		{http.MethodDelete, fmt.Sprintf("/todos/%d", todo.ID), ""},
+		{http.MethodPost, fmt.Sprintf("/todos/%d/pin", todo.ID), ""},
+	}
+	for _, w := range writes {
+		rec := request(e, w.method, w.target, w.body)
+		var resp errorResponse
+		decodeBody(t, rec, &resp)
+		if rec.Code != http.StatusServiceUnavailable || !strings.Contains(resp.Message, "read-only") {
+			t.Errorf("%s %s in read-only mode: got %d %+v, want 503", w.method, w.target, rec.Code, resp)
+		}
+	}
+	var todos []TodoItem
+	rec = request(e, http.MethodGet, "/todos", "")
+	decodeBody(t, rec, &todos)
+	if rec.Code != http.StatusOK || !slices.Equal(todoTitles(todos), []string{"kept"}) {
+		t.Errorf("read in read-only mode: got %d %q", rec.Code, todoTitles(todos))
+	}
+
+	if rec := request(e, http.MethodPost, "/admin/read-only?enabled=false", "", auth...); rec.Code != http.StatusOK {
+		t.Fatalf("disable read-only: got %d", rec.Code)
+	}
+	createTestTodo(t, e, `{"title":"new"}`)
+	if rec := request(e, http.MethodPost, "/admin/read-only?enabled=maybe", "", auth...); rec.Code != http.StatusBadRequest {
+		t.Errorf("enabled=maybe: got %d, want 400", rec.Code)
+	}
+}
+
+func TestErrorTraceID(t *testing.T) {
+	recorder := recordSpans(t)
+	setupDB(t)
+	t.Setenv("HTTP_MAX_URL_LENGTH", "64")
+	e := newTestServer(t)
+	e.GET("/test/fail", func(c echo.Context) error {
+		return errors.New("boom")
+	})
+
+	for _, enabled := range []bool{true, false} {
+		setForTest(t, &errorTraceID, enabled)
+		rec := request(e, http.MethodGet, "/test/fail", "")
+		var resp errorResponse
+		decodeBody(t, rec, &resp)
+		if rec.Code != http.StatusInternalServerError {
+			t.Fatalf("got %d, want 500", rec.Code)
+		}
+		want := ""
+		if enabled {
+			want = endedSpan(t, recorder, "GET /test/fail").SpanContext().TraceID().String()
+		}
+		if resp.TraceID != want {
+			t.Errorf("ERROR_TRACE_ID=%v: trace_id %q, want %q", enabled, resp.TraceID, want)
+		}
+	}
+
+	// The URL limit runs before routing, so there is no span to report.
+	setForTest(t, &errorTraceID, true)
+	rec := request(e, http.MethodGet, "/todos?"+strings.Repeat("a", 64), "")
+	if strings.Contains(rec.Body.String(), "trace_id") {
+		t.Errorf("error without a span: %s", rec.Body)
+	}
+}
+
+func TestStartupFailures(t *testing.T) {
+	tests := []struct {
+		name       string
+		env        []string
+		wantErr    string
+		wantListen bool
+		wantNoDB   bool
+	}{
+		{"healthy startup reaches the listener", nil, "bind refused by test", true, false},
+		{"tracer failure", []string{"OTEL_EXPORTER_OTLP_ENDPOINT=ftp://collector"}, "invalid OTEL_EXPORTER_OTLP_ENDPOINT", false, true},
+		{"invalid flag", []string{"DEMO_MODE=maybe"}, "invalid DEMO_MODE", false, true},
+		{"invalid sample ratio", []string{"TRACE_SAMPLE_RATIO=half"}, "invalid TRACE_SAMPLE_RATIO", false, true},
+		{"invalid server setting", []string{"REQUEST_TIMEOUT=soon"}, "invalid REQUEST_TIMEOUT", false, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "todos.db")
+			cmd := exec.Command(os.Args[0], "-test.run=^$")
+			cmd.Env = append(os.Environ(), "TODO_TEST_RUN=1", "DB_PATH="+path, "OTEL_EXPORTER_OTLP_ENDPOINT=localhost:1")
+			cmd.Env = append(cmd.Env, tt.env...)
+			var stdout, stderr bytes.Buffer
+			cmd.Stdout, cmd.Stderr = &stdout, &stderr
+			err := cmd.Run()
+			var exitErr *exec.ExitError
+			if !errors.As(err, &exitErr) {
+				t.Fatalf("run: got %v, want a nonzero exit", err)
+			}
+			if !strings.Contains(stderr.String(), tt.wantErr) {
+				t.Errorf("stderr %q does not mention %q", stderr.String(), tt.wantErr)
+			}
+			if got := strings.Contains(stdout.String(), "listening"); got != tt.wantListen {
+				t.Errorf("listener bound: got %v, want %v", got, tt.wantListen)
+			}
+			if _, err := os.Stat(path); tt.wantNoDB && !errors.Is(err, os.ErrNotExist) {
+				t.Errorf("database file created before telemetry was ready (stat: %v)", err)
+			}
+		})
+	}
+}
+
+func TestInvalidEnvValues(t *testing.T) {
+	tests := []struct {
+		name  string
+		key   string
+		value string
+		init  func() error
+	}{
+		{"pool size", "DB_MAX_OPEN_CONNS", "bogus", initDB},
+		{"idle time", "DB_CONN_MAX_IDLE_TIME", "forever", initDB},
+		{"backup flag", "BACKUP_BEFORE_MIGRATE", "sometimes", initDB},
+		{"warmup", "DB_WARMUP_CONNS", "1.5", initDB},
+		{"header timeout", "HTTP_READ_HEADER_TIMEOUT", "10", newServerErr},
+		{"header bytes", "HTTP_MAX_HEADER_BYTES", "1k", newServerErr},
+		{"header fields", "HTTP_MAX_HEADER_FIELDS", "many", newServerErr},
+		{"url length", "HTTP_MAX_URL_LENGTH", "long", newServerErr},
+		{"log sample rate", "LOG_SAMPLE_RATE", "most", newServerErr},
+		{"request timeout", "REQUEST_TIMEOUT", "soon", newServerErr},
+		{"degraded threshold", "READY_DB_DEGRADED_THRESHOLD", "slow", newServerErr},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setForTest(t, &dbPath, filepath.Join(t.TempDir(), "todos.db"))
+			t.Setenv(tt.key, tt.value)
+			err := tt.init()
+			if err == nil || !strings.Contains(err.Error(), "invalid "+tt.key) {
+				t.Errorf("%s=%s: got %v, want an invalid %s error", tt.key, tt.value, err, tt.key)
+			}
+		})
+	}
+}
+
+func newServerErr() error {
+	_, err := newServer()
+	return err
+}
+
+func TestRotateReleasesLongPolls(t *testing.T) {
+	setupDB(t)
+	t.Setenv("ADMIN_TOKEN", "secret")
+	e := newTestServer(t)
+	createTestTodo(t, e, `{"title":"archived"}`)
+
+	version, _ := todoChanges.current()
+	polled := make(chan *httptest.ResponseRecorder)
+	go func() {
+		polled <- request(e, http.MethodGet, fmt.Sprintf("/todos?wait=30s&version=%d", version), "")
+	}()
+	// The poll holds dbSwap for reading once it is parked.
+	for dbSwap.TryLock() {
+		dbSwap.Unlock()
+		time.Sleep(time.Millisecond)
+	}
+
+	start := time.Now()
+	archive := filepath.Join(t.TempDir(), "archive.db")
+	rec := request(e, http.MethodPost, "/admin/rotate?archive_path="+url.QueryEscape(archive), "", "Authorization", "Bearer secret")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("rotate: got %d %s", rec.Code, rec.Body)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("rotate took %v behind a parked long poll", elapsed)
+	}
+	if rec := <-polled; rec.Code != http.StatusOK {
+		t.Errorf("released poll: got %d", rec.Code)
+	}
+
+	// Once the swap is done, polls park again until the list changes.
+	version, _ = todoChanges.current()
+	start = time.Now()
+	request(e, http.MethodGet, fmt.Sprintf("/todos?wait=50ms&version=%d", version), "")
+	if elapsed := time.Since(start); elapsed < 50*time.Millisecond {
+		t.Errorf("poll after the rotate returned after %v, want it to wait", elapsed)
+	}
+}
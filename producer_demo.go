@@ -0,0 +1,80 @@
+//go:build demo
+
+package main
+
+import (
+	"log"
+	"math/rand"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const demoBuild = true
+
+var (
+	userStatus *prometheus.CounterVec
+	// userLatency is nil unless DEMO_LATENCY_HISTOGRAM is set.
+	userLatency *prometheus.HistogramVec
+)
+
+func initDemoMetrics() error {
+	userStatus = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "http_request_get_user_status_count",
+		Help: "Count of status returned by user",
+	}, []string{"user", "status"})
+	registerApp(userStatus)
+
+	latency, err := envBool("DEMO_LATENCY_HISTOGRAM", false)
+	if err != nil {
+		return err
+	}
+	if latency {
+		userLatency = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "http_request_get_user_duration_seconds",
+			Help:    "Simulated request latency by user",
+			Buckets: prometheus.DefBuckets,
+		}, []string{"user"})
+		registerApp(userLatency)
+	}
+	return nil
+}
+
+func producer() {
+	if userStatus == nil {
+		return
+	}
+
+	users := []string{"bob", "alice", "jack"}
+	for {
+		produceUserStatus(users)
+		time.Sleep(2 * time.Second)
+	}
+}
+
+// produceUserStatus records one synthetic status. Failures are logged so a
+// bad increment never stops the producer loop.
+func produceUserStatus(users []string) {
+	defer func() {
+		if r := recover(); r != nil {
+			log.Printf("producer: recovered from panic: %v", r)
+		}
+	}()
+
+	user := users[rand.Intn(len(users))]
+	status := "2xx"
+	if rand.Float64() > 0.8 {
+		status = "4xx"
+	}
+	counter, err := userStatus.GetMetricWithLabelValues(user, status)
+	if err != nil {
+		log.Printf("producer: failed to record user status: %v", err)
+		return
+	}
+	counter.Inc()
+
+	if userLatency != nil {
+		// A fast base latency with an exponential tail.
+		userLatency.WithLabelValues(user).Observe(0.01 + rand.ExpFloat64()*0.1)
+	}
+}
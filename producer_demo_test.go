@@ -0,0 +1,79 @@
+//go:build demo
+
+package main
+
+import (
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func newUserStatus(labels ...string) *prometheus.CounterVec {
+	return prometheus.NewCounterVec(prometheus.CounterOpts{Name: "test_user_status"}, labels)
+}
+
+func TestProduceUserStatusSurvivesFailures(t *testing.T) {
+	users := []string{"bob"}
+	tests := []struct {
+		name   string
+		status *prometheus.CounterVec
+	}{
+		// The label set does not match, so the increment returns an error.
+		{"label mismatch", newUserStatus("user")},
+		// Calling a nil vec panics.
+		{"panic", nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setForTest(t, &userStatus, tt.status)
+			for i := 0; i < 3; i++ {
+				produceUserStatus(users)
+			}
+		})
+	}
+
+	setForTest(t, &userStatus, newUserStatus("user", "status"))
+	for i := 0; i < 3; i++ {
+		produceUserStatus(users)
+	}
+	if got := testutil.CollectAndCount(userStatus); got == 0 {
+		t.Error("no user status recorded after the failures")
+	}
+}
+
+func TestProducerRunsInDemoBuild(t *testing.T) {
+	if !demoBuild {
+		t.Fatal("demoBuild is false in a demo build")
+	}
+	setForTest(t, &userStatus, newUserStatus("user", "status"))
+	produceUserStatus([]string{"bob"})
+	if got := testutil.CollectAndCount(userStatus); got != 1 {
+		t.Errorf("%d user status series, want 1", got)
+	}
+}
+
+func TestProducerLatencyHistogram(t *testing.T) {
+	setForTest(t, &userStatus, newUserStatus("user", "status"))
+	latency := prometheus.NewHistogramVec(prometheus.HistogramOpts{Name: "test_user_latency"}, []string{"user"})
+	for _, tt := range []struct {
+		name      string
+		histogram *prometheus.HistogramVec
+		want      uint64
+	}{
+		{"disabled", nil, 0},
+		{"enabled", latency, 5},
+	} {
+		setForTest(t, &userLatency, tt.histogram)
+		for i := 0; i < 5; i++ {
+			produceUserStatus([]string{"bob"})
+		}
+		var got uint64
+		if tt.want > 0 {
+			got = histogramCount(t, latency.WithLabelValues("bob"))
+		}
+		if got != tt.want {
+			t.Errorf("%s: %d latency observations, want %d", tt.name, got, tt.want)
+		}
+	}
+}
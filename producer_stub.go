@@ -0,0 +1,11 @@
+//go:build !demo
+
+package main
+
+// Production builds carry no synthetic load; build with -tags demo to get the
+// producer.
+const demoBuild = false
+
+func initDemoMetrics() error { return nil }
+
+func producer() {}
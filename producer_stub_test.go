@@ -0,0 +1,24 @@
+//go:build !demo
+
+package main
+
+import "testing"
+
+func TestProducerCompiledOut(t *testing.T) {
+	if demoBuild {
+		t.Fatal("demoBuild is true without the demo tag")
+	}
+	if err := initDemoMetrics(); err != nil {
+		t.Fatal(err)
+	}
+	producer() // returns at once instead of looping
+	families, err := appRegistry.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, mf := range families {
+		if mf.GetName() == "http_request_get_user_status_count" {
+			t.Error("demo metrics registered in a production build")
+		}
+	}
+}